@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/app"
+)
+
+func main() {
+	if os.Getenv("DEBUG") == "true" {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	startFlag := flag.String("start", "", "time to start replaying the jetstream from (RFC 3339)")
+	endFlag := flag.String("end", "", "time to stop replaying the jetstream at (RFC 3339), defaults to now")
+	flag.Parse()
+
+	start, err := time.Parse(time.RFC3339, *startFlag)
+	if err != nil {
+		slog.Error("invalid start time", "error", err)
+		os.Exit(1)
+	}
+	end := time.Now()
+	if *endFlag != "" {
+		end, err = time.Parse(time.RFC3339, *endFlag)
+		if err != nil {
+			slog.Error("invalid end time", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// Stop gracefully when the task is stopped
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	err = app.Backfill(ctx, start, end)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
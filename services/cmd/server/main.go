@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/app"
 )
@@ -11,7 +14,12 @@ func main() {
 	if os.Getenv("DEBUG") == "true" {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
-	err := app.Server()
+
+	// Stop gracefully when the task is stopped
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	err := app.Server(ctx)
 	if err != nil {
 		slog.Error(err.Error())
 	}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/app"
+)
+
+func main() {
+	if os.Getenv("DEBUG") == "true" {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	// Stop gracefully when the task is stopped
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	err := app.Standalone(ctx)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+// Serve internal metrics (such as Jetstream lag) on the admin port, if one is configured, returning the server so that it
+// can be shut down. Returns nil if no admin port is configured.
+// The admin port also allows the list of wanted DIDs to be changed at runtime, without authentication, so it only listens
+// on the loopback interface unless configured otherwise. It is not intended to be exposed publicly.
+func serveAdmin(cfg config.Config, jetstream *Jetstream) *http.Server {
+	if cfg.AdminPort == "" {
+		return nil
+	}
+
+	server := http.NewServeMux()
+	server.Handle("/debug/vars", expvar.Handler())
+
+	// Read the list of DIDs the Jetstream is scoped to.
+	server.HandleFunc("GET /jetstream/wanted-dids", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		dids := jetstream.WantedDIDs()
+		if dids == nil {
+			dids = []string{}
+		}
+		if err := json.NewEncoder(w).Encode(dids); err != nil {
+			slog.Error("failed to encode response", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	})
+
+	// Replace the list of DIDs the Jetstream is scoped to, without reconnecting.
+	// An empty list subscribes to all DIDs.
+	server.HandleFunc("PUT /jetstream/wanted-dids", func(w http.ResponseWriter, r *http.Request) {
+		var dids []string
+		if err := json.NewDecoder(r.Body).Decode(&dids); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := jetstream.SetWantedDIDs(dids); err != nil {
+			if errors.Is(err, errTooManyDIDs) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			slog.Error("failed to update wanted dids", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	httpServer := &http.Server{
+		Addr:    net.JoinHostPort(cfg.AdminHost, cfg.AdminPort),
+		Handler: server,
+	}
+	go func() {
+		slog.Info("starting admin server", "address", httpServer.Addr)
+		err := httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(util.WrapErr("admin server exited", err).Error())
+		}
+	}()
+	return httpServer
+}
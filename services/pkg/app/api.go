@@ -20,3 +20,15 @@ type APIService struct {
 	Type            string `json:"type"`
 	ServiceEndpoint string `json:"serviceEndpoint"`
 }
+
+// SubscriberMessage is sent to the Jetstream to change subscription options.
+type SubscriberMessage struct {
+	Type    string            `json:"type"`
+	Payload SubscriberOptions `json:"payload"`
+}
+
+type SubscriberOptions struct {
+	WantedCollections   []string `json:"wantedCollections"`
+	WantedDIDs          []string `json:"wantedDids"`
+	MaxMessageSizeBytes int      `json:"maxMessageSizeBytes"`
+}
@@ -2,6 +2,8 @@ package app
 
 import (
 	"embed"
+	"fmt"
+	"log/slog"
 
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
@@ -22,7 +24,7 @@ func NewApp() (App, error) {
 		return App{}, err
 	}
 
-	cache, err := cache.New(config)
+	cache, err := newCache(config)
 	if err != nil {
 		return App{}, err
 	}
@@ -33,6 +35,21 @@ func NewApp() (App, error) {
 	}, nil
 }
 
+// Create the cache backend selected by the config.
+func newCache(cfg config.Config) (Cache, error) {
+	switch cfg.CacheBackend {
+	case "valkey":
+		return cache.New(cfg)
+	case "bolt":
+		return cache.NewBolt(cfg)
+	case "memory":
+		slog.Warn("using in-memory cache, posts will be lost when the process exits")
+		return cache.NewMemory(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend '%s'", cfg.CacheBackend)
+	}
+}
+
 func (a App) Close() {
 	a.Cache.Close()
 }
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+// Backfill rebuilds the cache by replaying the Jetstream between the start and end times.
+// Posts are written to a staging namespace, and replace the live posts between the start and end times once it is reached.
+// This ensures the feed never serves a partially-built set of posts, and keeps any posts the live intake saved since.
+func Backfill(ctx context.Context, start, end time.Time) error {
+	slog.Info("starting backfill", "start", start, "end", end)
+
+	if !end.After(start) {
+		return errors.New("backfill end time must be after start time")
+	}
+
+	cfg, err := config.New()
+	if err != nil {
+		return util.WrapErr("failed to create config", err)
+	}
+
+	// Only Valkey has a staging namespace to rebuild the cache in
+	if cfg.CacheBackend != "valkey" {
+		return fmt.Errorf("backfill requires the valkey cache backend, not '%s'", cfg.CacheBackend)
+	}
+
+	// Events from the past always lag behind the wall-clock time, so the lag watchdog is disabled.
+	// Backfilled events are already in the Jetstream, so there's no need to record them.
+	cfg.JetstreamMaxLag = time.Duration(math.MaxInt64)
+	cfg.RecordDir = ""
+
+	staging, err := cache.NewStaging(cfg)
+	if err != nil {
+		return util.WrapErr("failed to create staging cache", err)
+	}
+	defer staging.Close()
+
+	return runBackfill(ctx, App{Config: cfg, Cache: staging}, start, end)
+}
+
+func runBackfill(ctx context.Context, app App, start, end time.Time) error {
+	staging, ok := app.Cache.(StagedCache)
+	if !ok {
+		return errors.New("cache does not support staging")
+	}
+
+	// Discard anything left behind by a previous backfill that didn't complete
+	if err := staging.Clear(); err != nil {
+		return err
+	}
+
+	jetstream, err := newJetstream(app.Config, start.UnixMicro())
+	if err != nil {
+		return util.WrapErr("failed to create jetstream reader", err)
+	}
+	defer jetstream.Close()
+	jetstream.until = end.UnixMicro()
+
+	// The live intake owns the cursor, so the backfill doesn't checkpoint its position
+	if err := process(ctx, app, jetstream, false); err != nil {
+		return util.WrapErr("failed to backfill", err)
+	}
+	if ctx.Err() != nil {
+		return errors.New("backfill interrupted before reaching end time, staged posts were not promoted")
+	}
+
+	promoted, err := staging.Promote(start.UnixMicro(), end.UnixMicro())
+	if err != nil {
+		return err
+	}
+	slog.Info("backfill complete", "promoted", promoted, "cursor", jetstream.Cursor())
+	return nil
+}
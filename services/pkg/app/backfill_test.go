@@ -0,0 +1,64 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/jetstreamtest"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+func TestBackfill(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	end := start.Add(time.Minute)
+
+	// The post is deleted after the end time, so it should remain in the backfilled cache
+	jetstream := jetstreamtest.NewServer(
+		loadSample(t, "standard-post.json", start.Add(time.Second).UnixMicro()),
+		loadSample(t, "like.json", start.Add(2*time.Second).UnixMicro()),
+		loadSample(t, "delete-post.json", end.Add(time.Second).UnixMicro()),
+	)
+	defer jetstream.Close()
+
+	cfg := testConfig(jetstream.URL())
+	cfg.WorkerPoolSize = 2
+	cfg.StreamBufferSize = 100
+	cfg.ShutdownTimeout = 5 * time.Second
+	cfg.CursorTTL = time.Hour
+	store := &stagedTestCache{Memory: cache.NewMemory(cfg)}
+
+	if err := runBackfill(t.Context(), App{Config: cfg, Cache: store}, start, end); err != nil {
+		t.Fatal(err)
+	}
+	if !store.cleared || !store.promoted {
+		t.Errorf("expected staging to be cleared and promoted, got cleared=%v promoted=%v", store.cleared, store.promoted)
+	}
+	if !saved(store, util.Hash("at://did:plc:ruzlll5u7u7pfxybmppqyxbx/app.bsky.feed.post/3lp3ldyiu2k2g")) {
+		t.Error("expected post to be backfilled")
+	}
+	if cursor, _ := store.ReadCursor(); cursor != 0 {
+		t.Errorf("expected backfill not to save a cursor, got %d", cursor)
+	}
+
+	// Caches without a staging namespace can't be backfilled
+	if err := runBackfill(t.Context(), App{Config: cfg, Cache: cache.NewMemory(cfg)}, start, end); err == nil {
+		t.Error("expected an error backfilling a cache without staging")
+	}
+}
+
+type stagedTestCache struct {
+	*cache.Memory
+	cleared  bool
+	promoted bool
+}
+
+func (c *stagedTestCache) Clear() error {
+	c.cleared = true
+	return nil
+}
+
+func (c *stagedTestCache) Promote(start, end int64) (int, error) {
+	c.promoted = true
+	return 0, nil
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+// Accumulates an intake worker's writes to the cache, so that they can be applied in a single round trip.
+// Writes are applied in the order they were added, which preserves the order of events for each post.
+// Events are only marked as done once their writes have been applied, so the checkpoint never skips unwritten events.
+type writeBatch struct {
+	cache  Cache
+	queue  *Queue
+	size   int
+	ops    []cache.Op
+	events []StreamEvent
+}
+
+func newWriteBatch(cache Cache, queue *Queue, size int) *writeBatch {
+	return &writeBatch{
+		cache: cache,
+		queue: queue,
+		size:  size,
+	}
+}
+
+// Add a write to the batch.
+func (b *writeBatch) add(op cache.Op) {
+	b.ops = append(b.ops, op)
+}
+
+// Mark an event as processed, once any writes added for it have been applied.
+func (b *writeBatch) done(event StreamEvent) {
+	b.events = append(b.events, event)
+}
+
+// Full reports whether the batch has reached its maximum size, and should be flushed.
+func (b *writeBatch) full() bool {
+	return len(b.ops) >= b.size
+}
+
+// Apply every write in the batch, then mark its events as done.
+// A failed batch is logged and discarded, as a failed write for a single event would be.
+func (b *writeBatch) flush(stats *Stats) {
+	if len(b.ops) > 0 {
+		start := time.Now()
+		err := b.cache.Apply(b.ops)
+		stats.batches++
+		stats.batchLatency += time.Since(start)
+		if err != nil {
+			slog.Error(util.WrapErr("failed to apply batch", err).Error(), "writes", len(b.ops))
+			stats.errors++
+		}
+	}
+
+	for _, event := range b.events {
+		b.queue.Done(event)
+	}
+	b.ops = b.ops[:0]
+	b.events = b.events[:0]
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+)
+
+func TestWriteBatch(t *testing.T) {
+	store := cache.NewMemory(config.Config{})
+	queue := newQueue(1, 10)
+	batch := newWriteBatch(store, queue, 3)
+	stats := newStats()
+
+	now := time.Now().UnixMicro()
+	first := cache.PostRecord{AtURI: "at://did:plc:a/app.bsky.feed.post/1", Timestamp: now}
+	second := cache.PostRecord{AtURI: "at://did:plc:a/app.bsky.feed.post/2", Timestamp: now}
+
+	// Writes to the same post are applied in order
+	for i, op := range []cache.Op{
+		cache.SaveOp("1", first),
+		cache.DeleteOp("1"),
+		cache.DeleteOp("2"),
+		cache.SaveOp("2", second),
+	} {
+		event := StreamEvent{TimeUS: int64(i + 1)}
+		queue.Push(t.Context(), event)
+		batch.add(op)
+		batch.done(<-queue.Partition(0))
+	}
+	if !batch.full() {
+		t.Error("expected batch to be full")
+	}
+
+	// Events aren't done until the batch is applied
+	if cursor := queue.Cursor(); cursor != 0 {
+		t.Errorf("expected no events to be done before flushing, got cursor %d", cursor)
+	}
+	batch.flush(&stats)
+	if cursor := queue.Cursor(); cursor != 4 {
+		t.Errorf("expected cursor 4 after flushing, got %d", cursor)
+	}
+	if stats.batches != 1 || stats.errors != 0 {
+		t.Errorf("expected 1 successful batch, got %d batches and %d errors", stats.batches, stats.errors)
+	}
+
+	if saved(store, "1") {
+		t.Error("expected post 1 to be deleted")
+	}
+	if !saved(store, "2") {
+		t.Error("expected post 2 to be saved")
+	}
+	if batch.full() {
+		t.Error("expected batch to be empty after flushing")
+	}
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+// When compression is requested, Jetstream sends each event as a binary frame compressed with zstd, using a custom dictionary.
+// The dictionary is copied from the Jetstream repository: https://github.com/bluesky-social/jetstream/blob/main/pkg/models/zstd_dictionary
+const zstdDictionaryPath = "assets/zstd_dictionary"
+
+var errMalformed = errors.New("malformed message")
+
+// Create a decoder for compressed Jetstream messages.
+func newDecompressor() (*zstd.Decoder, error) {
+	dict, err := assets.ReadFile(zstdDictionaryPath)
+	if err != nil {
+		return nil, util.WrapErr("failed to read zstd dictionary", err)
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict))
+	if err != nil {
+		return nil, util.WrapErr("failed to create zstd decoder", err)
+	}
+
+	return decoder, nil
+}
+
+// Decode a Jetstream message into an event, also returning the message as plain JSON.
+// Binary messages are decompressed first; text messages are plain JSON.
+// Errors caused by the contents of the message wrap errMalformed.
+func decodeEvent(messageType int, data []byte, decoder *zstd.Decoder) (StreamEvent, []byte, error) {
+	if messageType == websocket.BinaryMessage {
+		if decoder == nil {
+			return StreamEvent{}, nil, util.WrapErr("received compressed message without compression enabled", errMalformed)
+		}
+
+		decompressed, err := decoder.DecodeAll(data, nil)
+		if err != nil {
+			return StreamEvent{}, nil, util.WrapErr("failed to decompress message", errors.Join(errMalformed, err))
+		}
+		data = decompressed
+	}
+
+	event := StreamEvent{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return StreamEvent{}, nil, util.WrapErr("failed to read json", errors.Join(errMalformed, err))
+	}
+
+	return event, data, nil
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecodeCompressedEvent(t *testing.T) {
+	dict, err := assets.ReadFile(zstdDictionaryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := newDecompressor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob("../../sample-data/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected StreamEvent
+			if err := json.Unmarshal(data, &expected); err != nil {
+				t.Fatal(err)
+			}
+
+			// Compress the sample the same way Jetstream does, then decode it
+			compressed := encoder.EncodeAll(data, nil)
+			event, _, err := decodeEvent(websocket.BinaryMessage, compressed, decoder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(event, expected) {
+				t.Errorf("expected %+v, got %+v", expected, event)
+			}
+		})
+	}
+}
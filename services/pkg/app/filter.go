@@ -3,6 +3,7 @@ package app
 import (
 	"log/slog"
 	"strings"
+	"unicode"
 
 	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
@@ -124,3 +125,23 @@ func includePost(event StreamEvent) bool {
 
 	return true
 }
+
+// Score how well a post passed the content filters, from zero to one.
+// This is the proportion of the letters in the post's text that are lowercase, so posts written in sentence case score
+// higher than those that are mostly capitalized.
+func filterScore(text string) float64 {
+	letters, lowercase := 0, 0
+	for _, char := range text {
+		if !unicode.IsLetter(char) {
+			continue
+		}
+		letters++
+		if unicode.IsLower(char) {
+			lowercase++
+		}
+	}
+	if letters == 0 {
+		return 0
+	}
+	return float64(lowercase) / float64(letters)
+}
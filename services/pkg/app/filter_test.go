@@ -65,6 +65,23 @@ func TestIncludePost(t *testing.T) {
 	}
 }
 
+func TestFilterScore(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected float64
+	}{
+		{"just a quiet post", 1},
+		{"half CAPS", 0.5},
+		{"1234", 0},
+	}
+
+	for _, test := range tests {
+		if score := filterScore(test.text); score != test.expected {
+			t.Errorf("expected score %v for %q, got %v", test.expected, test.text, score)
+		}
+	}
+}
+
 func streamEvent(text, did string) StreamEvent {
 	return StreamEvent{
 		DID: did,
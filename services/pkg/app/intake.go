@@ -1,43 +1,55 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
-	"github.com/gorilla/websocket"
 )
 
 const (
-	WorkerPoolSize   = 1
-	StreamBufferSize = 10000
-	ErrorThreshold   = 10
-	JetstreamURL     = "wss://jetstream2.us-east.bsky.network/subscribe?wantedCollections=app.bsky.feed.post&wantedCollections=app.bsky.feed.repost&wantedCollections=app.bsky.feed.like"
+	ErrorThreshold = 10
 )
 
 type Stats struct {
-	started   time.Time
-	errors    int
-	ignored   int // Number ignored events
-	saves     int // Number of posts saved to the cache
-	blocked   int // Number of posts blocked by filters
-	deletions int // Number of deletions from the cache
+	started           time.Time
+	errors            int
+	ignored           int           // Number ignored events
+	saves             int           // Number of posts saved to the cache
+	blocked           int           // Number of posts blocked by filters
+	interactions      int           // Number of interactions with posts, which are counted if the post is cached
+	deletionsByAuthor int           // Number of deletions from the cache because the author deleted the post
+	purges            int           // Number of posts purged from the cache because the author's account became inactive
+	batches           int           // Number of batches of writes applied to the cache
+	batchLatency      time.Duration // Total time spent applying batches
+	maxQueue          int           // Largest number of events waiting in the queue when a batch was applied
+}
+
+// Average time spent applying a batch of writes.
+func (s Stats) avgBatchLatency() time.Duration {
+	if s.batches == 0 {
+		return 0
+	}
+	return s.batchLatency / time.Duration(s.batches)
 }
 
 func newStats() Stats {
 	return Stats{
-		started:   time.Now(),
-		errors:    0,
-		ignored:   0,
-		saves:     0,
-		deletions: 0,
+		started:      time.Now(),
+		errors:       0,
+		ignored:      0,
+		saves:        0,
+		interactions: 0,
 	}
 }
 
-func Intake() error {
+func Intake(ctx context.Context) error {
 	slog.Info("starting intake")
 
 	app, err := NewApp()
@@ -46,176 +58,283 @@ func Intake() error {
 	}
 	defer app.Close()
 
-	// Start worker threads.
-	// Each worker thread reads from the queue of events and processes them.
-	var wg sync.WaitGroup
-	wg.Add(WorkerPoolSize)
-	stream := make(chan StreamEvent, StreamBufferSize)
-	shutdown := make(chan struct{})
-	for i := 0; i < WorkerPoolSize; i++ {
-		go intakeWorker(i+1, stream, shutdown, app, &wg)
-	}
-
-	// Read the Jetstream cursor from the cache.
-	// If our application exited due to an error, our position in the Jetstream may have been saved.
-	cursor, err := app.Cache.ReadCursor()
-	if err != nil {
-		slog.Warn(util.WrapErr("failed to read cursor", err).Error())
-	} else {
-		if cursor > 0 {
-			slog.Info("discovered cursor", "cursor", cursor)
-
-			// Subtrack 5 seconds from the cursor to ensure we don't miss events
-			cursor -= 5 * 1_000_000
+	return runIntake(ctx, app)
+}
 
-			slog.Info("using cursor", "cursor", cursor)
+// Run the intake until the context is cancelled, or the event source is exhausted.
+func runIntake(ctx context.Context, app App) error {
+	// Events are read from the live Jetstream, unless we've been asked to replay a recording.
+	// Replays don't affect our saved position in the Jetstream.
+	live := app.Config.ReplayPath == ""
+	var source EventSource
+	if live {
+		// Read the Jetstream cursor from the cache.
+		// If our application exited due to an error, our position in the Jetstream may have been saved.
+		cursor, err := app.Cache.ReadCursor()
+		if err != nil {
+			slog.Warn(util.WrapErr("failed to read cursor", err).Error())
 		} else {
-			slog.Info("no cursor found, continuing without")
+			if cursor > 0 {
+				slog.Info("discovered cursor", "cursor", cursor)
+			} else {
+				slog.Info("no cursor found, continuing without")
+			}
 		}
-	}
-
-	// Build the URL to connect to the Jetstream
-	url := JetstreamURL
-	if cursor > 0 {
-		url += fmt.Sprintf("&cursor=%d", cursor)
-	}
 
-	// Connect to the Jetstream
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
-		return util.WrapErr("failed to dial jetstream", err)
+		// The reader keeps track of the most recent event timestamp, so that it can resume from the last event.
+		jetstream, err := newJetstream(app.Config, cursor)
+		if err != nil {
+			return util.WrapErr("failed to create jetstream reader", err)
+		}
+		defer jetstream.Close()
+
+		// The admin server stops along with the intake
+		if admin := serveAdmin(app.Config, jetstream); admin != nil {
+			defer func() {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), app.Config.ShutdownTimeout)
+				defer cancel()
+				if err := admin.Shutdown(shutdownCtx); err != nil {
+					slog.Error(util.WrapErr("failed to shut down admin server", err).Error())
+				}
+			}()
+		}
+		source = jetstream
+	} else {
+		source = newReplayer(app.Config.ReplayPath, app.Config.ReplaySpeed)
 	}
-	defer conn.Close()
-
-	// Keep track of the most recent event timestamp.
-	// If our connection is interrupted, we can use this to resume from the last event.
-	var latest int64
 
-	// Parse Jetstream messages as JSON and send them to the worker queue
-	errors := 0
-	for {
-		event := StreamEvent{}
-		err := conn.ReadJSON(&event)
+	return process(ctx, app, source, live)
+}
 
-		if err != nil {
-			errors++
-			slog.Warn(util.WrapErr("failed to read json", err).Error())
-
-			// If we encounter too many errors, save our position in the Jetstream and exit
-			if errors > ErrorThreshold {
-				slog.Error("encountered too many errors reading from jetstream, saving cursor and exiting")
-
-				if latest > 0 {
-					err := app.Cache.SaveCursor(latest)
-					if err != nil {
-						slog.Error(util.WrapErr("failed to save cursor", err).Error())
-					} else {
-						slog.Info("saved cursor", "cursor", latest)
-					}
-				} else {
-					slog.Warn("no cursor to save, exiting")
-				}
+// Process events from the source until the context is cancelled, or the source is exhausted.
+// If checkpointing, our position in the source is periodically saved as the cursor.
+// Returns an error if the source failed, or if queued events could not be processed before the shutdown timeout.
+func process(ctx context.Context, app App, source EventSource, checkpointing bool) error {
+	// Start worker threads.
+	// Each worker thread reads from the queue of events and processes them.
+	var workers sync.WaitGroup
+	workers.Add(app.Config.WorkerPoolSize)
+	queue := newQueue(app.Config.WorkerPoolSize, app.Config.StreamBufferSize)
+	shutdown := make(chan struct{})
+	for i := 0; i < app.Config.WorkerPoolSize; i++ {
+		go intakeWorker(i+1, queue, shutdown, app, source, &workers)
+	}
 
-				break
-			}
+	// Periodically save our position in the Jetstream.
+	// Only events that have been fully processed by workers are included, so that a restart doesn't skip queued events.
+	var checkpointer sync.WaitGroup
+	if checkpointing {
+		checkpointer.Add(1)
+		go checkpointCursor(queue, shutdown, app, &checkpointer)
+	}
 
-			continue
-		}
+	// Read events until we've been signalled to stop, or the source is exhausted.
+	// The Jetstream reader reconnects whenever the connection is interrupted.
+	sourceErr := source.Run(ctx, queue)
+	if sourceErr != nil {
+		sourceErr = util.WrapErr("failed to read events", sourceErr)
+	}
 
-		latest = event.TimeUS
-		stream <- event
+	// Stop accepting new events, and give workers a chance to drain the queue
+	slog.Info("stopping intake, draining queue", "queue", queue.Len())
+	queue.Close()
+	drained := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(drained)
+	}()
+	var drainErr error
+	select {
+	case <-drained:
+		slog.Info("drained queue")
+	case <-time.After(app.Config.ShutdownTimeout):
+		slog.Warn("timed out draining queue", "remaining", queue.Len())
+		drainErr = errors.New("timed out draining queue")
 	}
 
 	// Signal workers to exit, and wait for them to finish
 	close(shutdown)
-	wg.Wait()
-	return nil
+	workers.Wait()
+	checkpointer.Wait()
+
+	// Save our position in the source once all processing has stopped
+	if checkpointing {
+		if cursor := queue.Cursor(); saveCursor(cursor, app) {
+			slog.Info("saved cursor", "cursor", cursor)
+		} else {
+			slog.Warn("no cursor saved")
+		}
+	}
+	return errors.Join(sourceErr, drainErr)
 }
 
-func intakeWorker(id int, stream chan StreamEvent, shutdown chan struct{}, app App, wg *sync.WaitGroup) {
+func intakeWorker(id int, queue *Queue, shutdown chan struct{}, app App, source EventSource, wg *sync.WaitGroup) {
 	slog.Info(fmt.Sprintf("starting worker %d", id))
 	defer wg.Done()
 
 	stats := newStats()
+	partition := queue.Partition(id - 1)
+
+	// Writes are applied once the batch is full, or the interval has passed
+	batch := newWriteBatch(app.Cache, queue, app.Config.WriteBatchSize)
+	ticker := time.NewTicker(app.Config.WriteBatchInterval)
+	defer ticker.Stop()
+	flush := func() {
+		stats.maxQueue = max(stats.maxQueue, queue.Len())
+		batch.flush(&stats)
+	}
 
 	for {
 		event := StreamEvent{}
 		ok := true
 
 		select {
-		case event, ok = <-stream:
+		case event, ok = <-partition:
 			if !ok {
-				slog.Error("error reading message from channel")
-				continue
+				flush()
+				slog.Info(fmt.Sprintf("queue drained, shutting down worker %d", id))
+				return
 			}
+		case <-ticker.C:
+			flush()
+			continue
 		case <-shutdown:
+			flush()
 			slog.Info(fmt.Sprintf("shutting down worker %d", id))
 			return
 		}
 
-		// Determine whether the event should be processed
-		if !event.Valid() {
+		processEvent(event, app, &stats, batch)
+		batch.done(event)
+		if batch.full() {
+			flush()
+		}
+
+		// Log stats every ~5 minutes
+		if time.Since(stats.started) > 5*time.Minute {
+			slog.Info("intake stats", "saves", stats.saves, "interactions", stats.interactions, "deletions_by_author", stats.deletionsByAuthor, "purges", stats.purges, "errors", stats.errors, "ignored", stats.ignored, "blocked", stats.blocked, "batches", stats.batches, "avg_batch_latency", stats.avgBatchLatency(), "max_queue", stats.maxQueue, "queue", queue.Len(), "cursor", queue.Cursor(), "source", source)
+			stats = newStats()
+		}
+	}
+}
+
+// Process an event, adding any resulting writes to the batch.
+func processEvent(event StreamEvent, app App, stats *Stats, batch *writeBatch) {
+	// Determine whether the event should be processed
+	if !event.Valid() {
+		stats.ignored++
+		return
+	}
+
+	// Process the event
+	if event.IsInactiveAccount() {
+		// The account was deactivated, suspended or taken down, so none of its posts can be displayed.
+		// Purging reads the author's posts first, so it can't be batched. Apply pending writes beforehand to keep them in order.
+		batch.flush(stats)
+		purged, err := app.Cache.DeleteAuthorPosts(event.DID)
+		if err != nil {
+			slog.Error(util.WrapErr("failed to purge posts", err).Error(), "did", event.DID)
+			stats.errors++
+			return
+		}
+		if purged > 0 {
+			slog.Debug("purged posts from inactive account", "did", event.DID, "status", event.Account.Status, "posts", purged)
+		}
+		stats.purges += purged
+	} else if event.IsPostDeletion() {
+		// The author deleted their post, so remove it from the cache if it exists.
+		batch.add(cache.DeleteOp(util.Hash(postURI(event))))
+		stats.deletionsByAuthor++
+	} else if event.IsStandardPost() {
+		// Standard posts are standalone posts (i.e. not quotes, replies) and don't contain any media or external links.
+		// These posts are elligible to appear in the feed.
+
+		// Determine whether the post passes content filters.
+		if !includePost(event) {
+			stats.blocked++
+			return
+		}
+
+		// Save to cache in order for it to be displayed in the feed.
+		atURI := postURI(event)
+		text := event.GetText()
+
+		// Metadata is stored with the post, so the server can filter posts without looking them up.
+		batch.add(cache.SaveOp(util.Hash(atURI), cache.PostRecord{
+			AtURI:       atURI,
+			Timestamp:   event.TimeUS,
+			DID:         event.DID,
+			CID:         event.Commit.CID,
+			TextLength:  utf8.RuneCountInString(text),
+			Languages:   event.Commit.Record.Languages,
+			FilterScore: filterScore(text),
+		}))
+		stats.saves++
+	} else {
+		// For all other events, determine if they interact with a post (i.e. likes, reposts, quotes, replies).
+		// Count the interaction if the target post is cached. Posts with interactions are no longer lonely, but are kept
+		// for feeds that allow a few interactions, and to measure how long posts take to receive their first.
+		atURI, kind := targetPost(event)
+		if atURI == "" {
 			stats.ignored++
-			continue
+			return
 		}
+		batch.add(cache.InteractOp(util.Hash(atURI), kind, event.TimeUS))
+		stats.interactions++
+	}
+}
 
-		// Process the event
-		if event.IsStandardPost() {
-			// Standard posts are standalone posts (i.e. not quotes, replies) and don't contain any media or external links.
-			// These posts are elligible to appear in the feed.
+// Periodically save the cursor of the most recent fully-processed event, until shutdown.
+func checkpointCursor(queue *Queue, shutdown chan struct{}, app App, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-			// Determine whether the post passes content filters.
-			if !includePost(event) {
-				stats.blocked++
-				continue
-			}
+	ticker := time.NewTicker(app.Config.CursorCheckpoint)
+	defer ticker.Stop()
 
-			// Save to cache in order for it to be displayed in the feed.
-			atURI := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", event.DID, event.Commit.RKey)
-			err := app.Cache.SavePost(util.Hash(atURI), cache.PostRecord{
-				AtURI:     atURI,
-				Timestamp: event.TimeUS,
-			})
-			if err != nil {
-				slog.Error(fmt.Sprintf("failed to save post %s", atURI), "error", err)
-				stats.errors++
-				continue
-			}
-			stats.saves++
-		} else {
-			// For all other events, determine if they interact with a post (i.e. likes, quotes, replies).
-			// Delete the target post from the cache if it exists, to prevent it from appearing in the feed.
-			atURI := targetPost(event)
-			if atURI == "" {
-				stats.ignored++
-				continue
-			}
-			if err := app.Cache.DeletePost(util.Hash(atURI)); err != nil {
-				slog.Error(util.WrapErr("failed to delete post", err).Error(), "at_uri", atURI)
-				stats.errors++
-				continue
+	var saved int64
+	for {
+		select {
+		case <-ticker.C:
+			if cursor := queue.Cursor(); cursor != saved && saveCursor(cursor, app) {
+				saved = cursor
 			}
-			stats.deletions++
+		case <-shutdown:
+			return
 		}
+	}
+}
 
-		// Log stats every ~5 minutes
-		if time.Since(stats.started) > 5*time.Minute {
-			slog.Info("intake stats", "saves", stats.saves, "deletions", stats.deletions, "errors", stats.errors, "ignored", stats.ignored, "blocked", stats.blocked, "queue", len(stream))
-			stats = newStats()
-		}
+// Save the cursor to the cache, returning whether it was saved.
+func saveCursor(cursor int64, app App) bool {
+	if cursor == 0 {
+		return false
+	}
+	if err := app.Cache.SaveCursor(cursor); err != nil {
+		slog.Error(util.WrapErr("failed to save cursor", err).Error())
+		return false
 	}
+	slog.Debug("saved cursor", "cursor", cursor)
+	return true
 }
 
-// Given a stream event that references a post, return the AT URI of the post it is referencing.
-func targetPost(event StreamEvent) string {
-	if event.IsLike() || event.IsRepost() {
-		return event.Commit.Record.Subject.URI
+// Given a stream event for a post, return the AT URI of the post itself.
+func postURI(event StreamEvent) string {
+	return fmt.Sprintf("at://%s/app.bsky.feed.post/%s", event.DID, event.Commit.RKey)
+}
+
+// Given a stream event that references a post, return the AT URI of the post it is referencing, and how.
+func targetPost(event StreamEvent) (string, cache.InteractionKind) {
+	if event.IsLike() {
+		return event.Commit.Record.Subject.URI, cache.Like
+	}
+	if event.IsRepost() {
+		return event.Commit.Record.Subject.URI, cache.Repost
 	}
 	if event.IsQuotePost() {
-		return event.Commit.Record.Embed.Record.URI
+		return event.Commit.Record.Embed.Record.URI, cache.Quote
 	}
 	if event.IsReplyPost() {
-		return event.Commit.Record.Reply.Parent.URI
+		return event.Commit.Record.Reply.Parent.URI, cache.Reply
 	}
-	return ""
+	return "", ""
 }
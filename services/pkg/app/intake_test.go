@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/jetstreamtest"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+func TestIntake(t *testing.T) {
+	jetstream := jetstreamtest.NewServer()
+	defer jetstream.Close()
+
+	cfg := testConfig(jetstream.URL())
+	cfg.WorkerPoolSize = 2
+	cfg.StreamBufferSize = 100
+	cfg.CursorCheckpoint = time.Hour
+	cfg.ShutdownTimeout = 5 * time.Second
+	cfg.CursorTTL = time.Hour
+	store := cache.NewMemory(cfg)
+	app := App{Config: cfg, Cache: store}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() { done <- runIntake(ctx, app) }()
+	if !jetstream.AwaitSubscriber(5 * time.Second) {
+		t.Fatal("intake did not connect to the jetstream")
+	}
+
+	// A standard post is saved to the cache
+	now := time.Now().UnixMicro()
+	post := loadSample(t, "standard-post.json", now)
+	jetstream.Publish(post)
+	hash := util.Hash("at://did:plc:ruzlll5u7u7pfxybmppqyxbx/app.bsky.feed.post/3lp3ldyiu2k2g")
+	await(t, "post to be saved", func() bool { return saved(store, hash) })
+
+	// Along with its metadata
+	record, _ := store.ReadPost(hash)
+	if record.DID != "did:plc:ruzlll5u7u7pfxybmppqyxbx" || record.CID == "" || record.TextLength != 12 || !slices.Equal(record.Languages, []string{"en"}) {
+		t.Errorf("expected post metadata to be saved, got %+v", record)
+	}
+
+	// Likes are counted, rather than removing the post
+	like, err := jetstreamtest.NewEvent(fmt.Appendf(nil, `{"did":"did:plc:other","time_us":%d,"kind":"commit","commit":{"operation":"create","collection":"app.bsky.feed.like","rkey":"1","record":{"$type":"app.bsky.feed.like","subject":{"uri":"at://did:plc:ruzlll5u7u7pfxybmppqyxbx/app.bsky.feed.post/3lp3ldyiu2k2g"}}}}`, now+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jetstream.Publish(like)
+	await(t, "like to be counted", func() bool {
+		record, _ := store.ReadPost(hash)
+		return record.Interactions.Likes == 1 && record.FirstInteraction == now+1
+	})
+
+	// Then removed once its author deletes it
+	deletion := loadSample(t, "delete-post.json", now+2)
+	jetstream.Publish(deletion)
+	await(t, "post to be deleted", func() bool { return !saved(store, hash) })
+
+	// On shutdown, the cursor of the last processed event is saved
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("intake did not shut down")
+	}
+	if cursor, _ := store.ReadCursor(); cursor != deletion.TimeUS {
+		t.Errorf("expected cursor %d, got %d", deletion.TimeUS, cursor)
+	}
+}
+
+func loadSample(t *testing.T, file string, timeUS int64) jetstreamtest.Event {
+	t.Helper()
+
+	event, err := jetstreamtest.LoadSample("../../sample-data/"+file, timeUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// Poll until the condition is met, failing the test after a few seconds.
+func await(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func saved(c Cache, hash string) bool {
+	post, err := c.ReadPost(hash)
+	return err == nil && !post.IsEmpty()
+}
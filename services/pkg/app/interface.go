@@ -1,15 +1,43 @@
 package app
 
 import (
+	"context"
+	"log/slog"
+
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
 )
 
+// EventSource supplies events to the intake workers, such as the live Jetstream or a recording.
+type EventSource interface {
+	// Run pushes events to the queue until the source is exhausted or the context is cancelled.
+	Run(ctx context.Context, queue *Queue) error
+	// LogValue summarizes the source for the periodic intake stats.
+	slog.LogValuer
+}
+
 type Cache interface {
 	SavePost(hash string, post cache.PostRecord) error
 	ReadPost(hash string) (cache.PostRecord, error)
-	ReadPosts(n int, cursor uint64) ([]cache.PostRecord, uint64, error)
+	ReadPosts(n int, cursor uint64, criteria cache.Criteria) ([]cache.PostRecord, uint64, error)
+	Interact(hash string, kind cache.InteractionKind, timestamp int64) error
 	DeletePost(hash string) error
+	DeleteAuthorPosts(did string) (int, error)
+	Apply(ops []cache.Op) error
 	SaveCursor(cursor int64) error
 	ReadCursor() (int64, error)
 	Close()
 }
+
+// StagedCache is a cache whose posts can be rebuilt in a staging namespace, then merged into the live posts.
+// Promoting replaces live posts between the start and end times, given in microseconds.
+type StagedCache interface {
+	Cache
+	Clear() error
+	Promote(start, end int64) (int, error)
+}
+
+// MigratableCache is a cache that stores encoded post records, which can be rewritten in the current version.
+type MigratableCache interface {
+	Cache
+	Migrate(ctx context.Context) (int, error)
+}
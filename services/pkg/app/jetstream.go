@@ -0,0 +1,459 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ReconnectBaseDelay = time.Second
+	ReconnectMaxDelay  = time.Minute
+	CursorSafetyMargin = 5 * 1_000_000 // 5 seconds, in microseconds
+	MaxWantedDIDs      = 10_000        // Limit imposed by Jetstream
+)
+
+// Collections to subscribe to on the Jetstream.
+var JetstreamCollections = []string{"app.bsky.feed.post", "app.bsky.feed.repost", "app.bsky.feed.like"}
+
+// Lag between the time of the most recent event and the wall-clock time, exported as a metric.
+var jetstreamLag = expvar.NewInt("jetstream_lag_ms")
+
+var (
+	errStalled     = errors.New("no events received from jetstream within stall timeout")
+	errLagging     = errors.New("jetstream events lagging behind wall-clock time")
+	errTooManyDIDs = fmt.Errorf("cannot subscribe to more than %d dids", MaxWantedDIDs)
+	errReachedEnd  = errors.New("reached end of requested range")
+)
+
+// Jetstream maintains a connection to the Jetstream and pushes events to the worker queue.
+// If the connection is interrupted, it reconnects with exponential backoff and resumes from the most recent event.
+// When an endpoint fails to connect or stalls, the next endpoint in the list is used.
+//
+// In scoped mode, only events from a list of wanted DIDs are received. Note that this includes interactions,
+// so a post is only considered lonely with respect to other wanted DIDs.
+type Jetstream struct {
+	mu           sync.Mutex // Guards endpoint health, wanted DIDs and the current connection
+	endpoints    []*endpoint
+	wantedDIDs   []string        // If non-empty, only receive events from these DIDs
+	conn         *websocket.Conn // Current connection, if any
+	current      int             // Index of the endpoint currently in use
+	cursor       atomic.Int64    // Timestamp (time_us) of the most recent event read from the Jetstream
+	until        int64           // If non-zero, stop reading once events pass this timestamp (time_us)
+	lag          atomic.Int64
+	stallTimeout time.Duration
+	maxLag       time.Duration
+	baseDelay    time.Duration
+	maxDelay     time.Duration
+	decoder      *zstd.Decoder // Decompresses messages, if compression is enabled
+	recorder     *Recorder     // Records messages for later replay, if enabled
+}
+
+type endpoint struct {
+	url         string
+	lastSuccess time.Time // Time the most recent event was received from this endpoint
+	failures    int       // Number of consecutive failures
+}
+
+// EndpointHealth is a snapshot of the health of a single Jetstream endpoint.
+type EndpointHealth struct {
+	URL         string
+	LastSuccess time.Time
+	Failures    int
+}
+
+// JetstreamHealth is a snapshot of the health of every Jetstream endpoint, in order of preference.
+type JetstreamHealth []EndpointHealth
+
+func newJetstream(cfg config.Config, cursor int64) (*Jetstream, error) {
+	endpoints := make([]*endpoint, len(cfg.JetstreamEndpoints))
+	for i, u := range cfg.JetstreamEndpoints {
+		endpoints[i] = &endpoint{url: u}
+	}
+
+	// Compressed messages use significantly less bandwidth, at the cost of some CPU
+	var decoder *zstd.Decoder
+	if cfg.JetstreamCompress {
+		var err error
+		decoder, err = newDecompressor()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.JetstreamWantedDIDs) > MaxWantedDIDs {
+		return nil, errTooManyDIDs
+	}
+
+	var recorder *Recorder
+	if cfg.RecordDir != "" {
+		recorder = newRecorder(cfg.RecordDir, cfg.RecordCompress, cfg.RecordRotate)
+	}
+
+	j := &Jetstream{
+		endpoints:    endpoints,
+		wantedDIDs:   cfg.JetstreamWantedDIDs,
+		stallTimeout: cfg.JetstreamStall,
+		maxLag:       cfg.JetstreamMaxLag,
+		baseDelay:    ReconnectBaseDelay,
+		maxDelay:     ReconnectMaxDelay,
+		decoder:      decoder,
+		recorder:     recorder,
+	}
+	j.cursor.Store(cursor)
+	return j, nil
+}
+
+// Cursor returns the timestamp of the most recent event read from the Jetstream.
+func (j *Jetstream) Cursor() int64 {
+	return j.cursor.Load()
+}
+
+// Lag returns how far the most recent event lags behind the wall-clock time.
+func (j *Jetstream) Lag() time.Duration {
+	return time.Duration(j.lag.Load()) * time.Microsecond
+}
+
+// Health returns a snapshot of the health of each endpoint.
+func (j *Jetstream) Health() JetstreamHealth {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	result := make(JetstreamHealth, len(j.endpoints))
+	for i, e := range j.endpoints {
+		result[i] = EndpointHealth{
+			URL:         e.url,
+			LastSuccess: e.lastSuccess,
+			Failures:    e.failures,
+		}
+	}
+	return result
+}
+
+// WantedDIDs returns the DIDs currently subscribed to, or nil if subscribed to all DIDs.
+func (j *Jetstream) WantedDIDs() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Clone(j.wantedDIDs)
+}
+
+// SetWantedDIDs changes the DIDs subscribed to, without reconnecting.
+// An empty list subscribes to all DIDs. The list is also used for any future connections.
+func (j *Jetstream) SetWantedDIDs(dids []string) error {
+	if len(dids) > MaxWantedDIDs {
+		return errTooManyDIDs
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.wantedDIDs = slices.Clone(dids)
+	if j.conn == nil {
+		return nil
+	}
+	j.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if err := j.conn.WriteJSON(j.optionsUpdate()); err != nil {
+		return util.WrapErr("failed to send options update", err)
+	}
+
+	slog.Info("updated wanted dids", "count", len(dids))
+	return nil
+}
+
+// Build a subscriber message that replaces the subscription options on an existing connection.
+// Must be called with the lock held.
+func (j *Jetstream) optionsUpdate() SubscriberMessage {
+	return SubscriberMessage{
+		Type: "options_update",
+		Payload: SubscriberOptions{
+			WantedCollections: JetstreamCollections,
+			WantedDIDs:        j.wantedDIDs,
+		},
+	}
+}
+
+// Close releases resources held by the reader, flushing any recording.
+func (j *Jetstream) Close() {
+	if j.recorder != nil {
+		if err := j.recorder.Close(); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+}
+
+// Run reads events from the Jetstream and pushes them to the queue until the context is cancelled,
+// or until the end of the requested range is reached.
+func (j *Jetstream) Run(ctx context.Context, queue *Queue) error {
+	attempt := 0
+	for {
+		endpoint := j.endpoints[j.current]
+		received, err := j.read(ctx, endpoint, queue)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errReachedEnd) {
+			slog.Info("reached end of jetstream range", "cursor", j.Cursor())
+			return nil
+		}
+
+		// Reset the backoff if the connection was healthy before it failed.
+		// Otherwise, consider the endpoint unhealthy and rotate to the next one.
+		stalled := errors.Is(err, errStalled) || errors.Is(err, errLagging)
+		if received > 0 && !stalled {
+			attempt = 0
+		} else {
+			j.mu.Lock()
+			endpoint.failures++
+			j.current = (j.current + 1) % len(j.endpoints)
+			j.mu.Unlock()
+		}
+		attempt++
+
+		// Try each endpoint once before backing off
+		delay := time.Duration(0)
+		if attempt >= len(j.endpoints) {
+			delay = backoff(attempt-len(j.endpoints)+1, j.baseDelay, j.maxDelay)
+		}
+		slog.Warn(util.WrapErr("jetstream connection interrupted", err).Error(), "endpoint", endpoint.url, "attempt", attempt, "delay", delay, "cursor", j.Cursor())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Connect to a Jetstream endpoint and read events until the connection fails.
+// Returns the number of events received over the connection.
+func (j *Jetstream) read(ctx context.Context, endpoint *endpoint, queue *Queue) (int, error) {
+	scoped := len(j.WantedDIDs()) > 0
+	address, err := j.subscribeURL(endpoint.url, scoped)
+	if err != nil {
+		return 0, err
+	}
+
+	slog.Info("connecting to jetstream", "url", address)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, address, nil)
+	if err != nil {
+		return 0, util.WrapErr("failed to dial jetstream", err)
+	}
+	defer conn.Close()
+
+	// In scoped mode, the list of DIDs is too long to fit in the URL, so it is sent as the first message.
+	// Jetstream waits for this message before sending any events.
+	// The list may have changed since the URL was built, so the current list is sent whenever Jetstream expects a
+	// message, even if it is now empty. Any later changes are sent over the connection by SetWantedDIDs.
+	j.mu.Lock()
+	if scoped || len(j.wantedDIDs) > 0 {
+		if err := conn.WriteJSON(j.optionsUpdate()); err != nil {
+			j.mu.Unlock()
+			return 0, util.WrapErr("failed to send options update", err)
+		}
+	}
+	j.conn = conn
+	j.mu.Unlock()
+	defer func() {
+		j.mu.Lock()
+		j.conn = nil
+		j.mu.Unlock()
+	}()
+
+	// Close the connection if the context is cancelled, in order to unblock any pending read.
+	// Periodically ping the server to keep the connection alive; a failed ping also closes the connection.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(j.stallTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second*5)); err != nil {
+					slog.Warn(util.WrapErr("failed to ping jetstream", err).Error())
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	// Parse Jetstream messages and push them to the worker queue
+	received := 0
+	errs := 0
+	watchdog := lagWatchdog{maxLag: j.maxLag, grace: j.stallTimeout}
+	for {
+		// If no event arrives before the deadline, the read fails and we reconnect
+		conn.SetReadDeadline(time.Now().Add(j.stallTimeout))
+
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return received, errStalled
+			}
+			return received, util.WrapErr("failed to read from jetstream", err)
+		}
+
+		// A malformed message doesn't affect the connection, so skip it unless it happens repeatedly
+		event, raw, err := decodeEvent(messageType, data, j.decoder)
+		if err != nil {
+			errs++
+			slog.Warn(err.Error())
+			if errs > ErrorThreshold {
+				return received, errors.New("encountered too many errors reading from jetstream")
+			}
+			continue
+		}
+
+		errs = 0
+		if j.until > 0 && event.TimeUS > j.until {
+			return received, errReachedEnd
+		}
+		received++
+		j.cursor.Store(event.TimeUS)
+
+		if j.recorder != nil {
+			if err := j.recorder.Record(raw); err != nil {
+				slog.Warn(util.WrapErr("failed to record message", err).Error())
+			}
+		}
+
+		lag := time.Now().UnixMicro() - event.TimeUS
+		j.lag.Store(lag)
+		jetstreamLag.Set(lag / 1000)
+		// Lag caused by our own backpressure isn't the endpoint's fault, so it doesn't count towards the watchdog
+		if queue.Saturated() {
+			watchdog.reset()
+		} else if watchdog.lagging(time.Duration(lag) * time.Microsecond) {
+			return received, errLagging
+		}
+
+		j.mu.Lock()
+		endpoint.lastSuccess = time.Now()
+		endpoint.failures = 0
+		j.mu.Unlock()
+
+		if err := queue.Push(ctx, event); err != nil {
+			return received, err
+		}
+	}
+}
+
+// Detects when events lag behind the wall-clock time for a sustained period.
+// Some lag is expected while catching up from a cursor, so it is only considered a problem if it isn't shrinking.
+type lagWatchdog struct {
+	maxLag time.Duration
+	grace  time.Duration
+	since  time.Time     // Time the lag was first observed above the threshold
+	start  time.Duration // Lag at that time
+}
+
+func (w *lagWatchdog) lagging(lag time.Duration) bool {
+	if lag <= w.maxLag {
+		w.since = time.Time{}
+		return false
+	}
+	if w.since.IsZero() {
+		w.since = time.Now()
+		w.start = lag
+		return false
+	}
+	if time.Since(w.since) < w.grace {
+		return false
+	}
+
+	// If we've caught up since the lag was first observed, start a new grace period
+	if lag < w.start {
+		w.since = time.Now()
+		w.start = lag
+		return false
+	}
+	return true
+}
+
+// Start over, as if the lag had never been observed above the threshold.
+func (w *lagWatchdog) reset() {
+	w.since = time.Time{}
+}
+
+// Build the URL used to subscribe to a Jetstream endpoint.
+// Subtract a few seconds from the cursor to ensure we don't miss events.
+// If scoped, Jetstream is told to wait for the list of DIDs before sending any events.
+func (j *Jetstream) subscribeURL(endpoint string, scoped bool) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", util.WrapErr("failed to parse jetstream endpoint", err)
+	}
+
+	query := u.Query()
+	query["wantedCollections"] = JetstreamCollections
+	if cursor := j.Cursor(); cursor > 0 {
+		query.Set("cursor", strconv.FormatInt(cursor-CursorSafetyMargin, 10))
+	}
+	if j.decoder != nil {
+		query.Set("compress", "true")
+	}
+	if scoped {
+		query.Set("requireHello", "true")
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Calculate the delay before the given reconnect attempt.
+// The delay doubles with each attempt up to the maximum, and half of it is randomized to avoid reconnecting in lockstep.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// LogValue summarizes the connection for the periodic intake stats.
+func (j *Jetstream) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("lag", j.Lag().String()),
+		slog.Any("endpoints", j.Health()),
+	)
+}
+
+// LogValue formats endpoint health for the periodic intake stats.
+func (h JetstreamHealth) LogValue() slog.Value {
+	attrs := make([]slog.Attr, len(h))
+	for i, e := range h {
+		lastSuccess := "never"
+		if !e.LastSuccess.IsZero() {
+			lastSuccess = e.LastSuccess.Format(time.RFC3339)
+		}
+		attrs[i] = slog.Group(e.URL, "last_success", lastSuccess, "failures", e.Failures)
+	}
+	return slog.GroupValue(attrs...)
+}
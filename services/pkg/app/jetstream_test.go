@@ -0,0 +1,352 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+	"github.com/gorilla/websocket"
+)
+
+func TestJetstreamReconnect(t *testing.T) {
+	// Each connection serves a batch of events, then drops without a close message
+	batches := [][]int64{
+		{1_000_000_000, 1_000_000_100, 1_000_000_200},
+		{1_000_000_300, 1_000_000_400},
+	}
+	cursors := make(chan string, len(batches)+1)
+
+	upgrader := websocket.Upgrader{}
+	var connections atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		cursors <- r.URL.Query().Get("cursor")
+		n := int(connections.Add(1)) - 1
+		if n >= len(batches) {
+			// Hold the final connection open until the client disconnects
+			conn.ReadMessage()
+			return
+		}
+		batch := batches[n]
+
+		for _, timeUS := range batch {
+			conn.WriteJSON(StreamEvent{DID: validDID, TimeUS: timeUS, Kind: "commit"})
+		}
+	}))
+	defer server.Close()
+
+	jetstream, err := newJetstream(testConfig(websocketURL(server)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jetstream.baseDelay = time.Millisecond
+	jetstream.maxDelay = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := newQueue(1, 10)
+	go jetstream.Run(ctx, queue)
+
+	for _, batch := range batches {
+		for _, expected := range batch {
+			select {
+			case event := <-queue.Partition(0):
+				if event.TimeUS != expected {
+					t.Fatalf("expected event %d, got %d", expected, event.TimeUS)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for event %d", expected)
+			}
+		}
+	}
+
+	// The first connection has no cursor, subsequent connections resume from the latest event
+	expected := []string{"", "995000200", "995000400"}
+	for _, cursor := range expected {
+		select {
+		case got := <-cursors:
+			if got != cursor {
+				t.Errorf("expected cursor %q, got %q", cursor, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for connection with cursor %q", cursor)
+		}
+	}
+}
+
+func TestJetstreamFailover(t *testing.T) {
+	// The first endpoint refuses connections
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailable.Close()
+
+	// The second endpoint serves a single event
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteJSON(StreamEvent{DID: validDID, TimeUS: 1_000_000_000, Kind: "commit"})
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	jetstream, err := newJetstream(testConfig(websocketURL(unavailable), websocketURL(server)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jetstream.baseDelay = time.Millisecond
+	jetstream.maxDelay = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := newQueue(1, 10)
+	go jetstream.Run(ctx, queue)
+
+	select {
+	case event := <-queue.Partition(0):
+		if event.TimeUS != 1_000_000_000 {
+			t.Fatalf("expected event %d, got %d", 1_000_000_000, event.TimeUS)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	health := jetstream.Health()
+	if health[0].Failures == 0 {
+		t.Errorf("expected failures to be recorded for the unavailable endpoint")
+	}
+	if health[1].LastSuccess.IsZero() || health[1].Failures != 0 {
+		t.Errorf("expected the available endpoint to be healthy, got %+v", health[1])
+	}
+}
+
+func TestJetstreamStall(t *testing.T) {
+	// The server sends a single event on each connection, then goes silent without closing the socket
+	var connections atomic.Int32
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		n := connections.Add(1)
+		conn.WriteJSON(StreamEvent{DID: validDID, TimeUS: int64(n), Kind: "commit"})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	cfg := testConfig(websocketURL(server))
+	cfg.JetstreamStall = 100 * time.Millisecond
+	jetstream, err := newJetstream(cfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jetstream.baseDelay = time.Millisecond
+	jetstream.maxDelay = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := newQueue(1, 10)
+	go jetstream.Run(ctx, queue)
+
+	// Receiving an event from a second connection means the watchdog forced a reconnect
+	for i := int64(1); i <= 2; i++ {
+		select {
+		case event := <-queue.Partition(0):
+			if event.TimeUS != i {
+				t.Fatalf("expected event %d, got %d", i, event.TimeUS)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+}
+
+func TestJetstreamWantedDIDs(t *testing.T) {
+	var connections atomic.Int32
+	updates := make(chan SubscriberMessage, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		connections.Add(1)
+		if r.URL.Query().Get("requireHello") != "true" {
+			t.Error("expected scoped subscription to require hello")
+		}
+		for {
+			var message SubscriberMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			updates <- message
+			conn.WriteJSON(StreamEvent{DID: validDID, TimeUS: 1, Kind: "commit"})
+		}
+	}))
+	defer server.Close()
+
+	cfg := testConfig(websocketURL(server))
+	cfg.JetstreamWantedDIDs = []string{validDID}
+	jetstream, err := newJetstream(cfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := newQueue(1, 10)
+	go jetstream.Run(ctx, queue)
+
+	// The wanted DIDs are sent as the first message on the connection
+	expectUpdate := func(expected []string) {
+		t.Helper()
+		select {
+		case message := <-updates:
+			if message.Type != "options_update" || !slices.Equal(message.Payload.WantedDIDs, expected) {
+				t.Errorf("expected options update for %v, got %+v", expected, message)
+			}
+			if !slices.Equal(message.Payload.WantedCollections, JetstreamCollections) {
+				t.Errorf("expected options update to retain wanted collections, got %v", message.Payload.WantedCollections)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for options update")
+		}
+	}
+	expectUpdate([]string{validDID})
+
+	// Wait for the connection to be established before changing the wanted DIDs
+	<-queue.Partition(0)
+	if err := jetstream.SetWantedDIDs([]string{validDID, blockedDID}); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate([]string{validDID, blockedDID})
+
+	if connections.Load() != 1 {
+		t.Errorf("expected wanted dids to change without reconnecting, got %d connections", connections.Load())
+	}
+}
+
+func TestJetstreamWantedDIDsClearedWhileConnecting(t *testing.T) {
+	var jetstream *Jetstream
+	updates := make(chan SubscriberMessage, 10)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The subscription is cleared after the URL requiring hello was built, but before the connection is ready
+		if err := jetstream.SetWantedDIDs(nil); err != nil {
+			t.Error(err)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var message SubscriberMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			return
+		}
+		updates <- message
+		conn.ReadJSON(&message)
+	}))
+	defer server.Close()
+
+	cfg := testConfig(websocketURL(server))
+	cfg.JetstreamWantedDIDs = []string{validDID}
+	jetstream, err := newJetstream(cfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go jetstream.Run(ctx, newQueue(1, 10))
+
+	// Jetstream is still waiting for hello, so an update must be sent even though the list is now empty
+	select {
+	case message := <-updates:
+		if message.Type != "options_update" || len(message.Payload.WantedDIDs) != 0 {
+			t.Errorf("expected options update for all dids, got %+v", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for options update")
+	}
+}
+
+func TestLagWatchdog(t *testing.T) {
+	watchdog := lagWatchdog{maxLag: time.Second, grace: 0}
+
+	if watchdog.lagging(500 * time.Millisecond) {
+		t.Error("expected lag below the threshold to be ignored")
+	}
+	if watchdog.lagging(10 * time.Second) {
+		t.Error("expected the first lagging event to start a grace period")
+	}
+	if watchdog.lagging(5 * time.Second) {
+		t.Error("expected a shrinking lag to be treated as catching up")
+	}
+	if !watchdog.lagging(6 * time.Second) {
+		t.Error("expected a growing lag to force a reconnect")
+	}
+
+	watchdog.reset()
+	if watchdog.lagging(10 * time.Second) {
+		t.Error("expected a reset to start a new grace period")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{attempt: 1, min: 500 * time.Millisecond, max: time.Second},
+		{attempt: 3, min: 2 * time.Second, max: 4 * time.Second},
+		{attempt: 20, min: 30 * time.Second, max: time.Minute},
+	}
+
+	for _, test := range tests {
+		delay := backoff(test.attempt, ReconnectBaseDelay, ReconnectMaxDelay)
+		if delay < test.min || delay > test.max {
+			t.Errorf("attempt %d: expected delay between %v and %v, got %v", test.attempt, test.min, test.max, delay)
+		}
+	}
+}
+
+func websocketURL(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/subscribe"
+}
+
+func testConfig(endpoints ...string) config.Config {
+	return config.Config{
+		JetstreamEndpoints: endpoints,
+		JetstreamStall:     5 * time.Second,
+		JetstreamMaxLag:    time.Duration(math.MaxInt64),
+		WriteBatchSize:     10,
+		WriteBatchInterval: 10 * time.Millisecond,
+	}
+}
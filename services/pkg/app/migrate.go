@@ -0,0 +1,37 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+// Migrate rewrites post records stored by previous versions of the services in the current version.
+// It's safe to run while the intake and server are running.
+func Migrate(ctx context.Context) error {
+	slog.Info("starting migration")
+
+	app, err := NewApp()
+	if err != nil {
+		return util.WrapErr("failed to create app", err)
+	}
+	defer app.Close()
+
+	return runMigrate(ctx, app)
+}
+
+func runMigrate(ctx context.Context, app App) error {
+	migratable, ok := app.Cache.(MigratableCache)
+	if !ok {
+		return errors.New("cache does not store encoded records, so there is nothing to migrate")
+	}
+
+	migrated, err := migratable.Migrate(ctx)
+	if err != nil {
+		return util.WrapErr("failed to migrate records", err)
+	}
+	slog.Info("migration complete", "migrated", migrated)
+	return nil
+}
@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// Queue hands events read from the Jetstream to the intake workers.
+// Events are partitioned by the author of the post they affect, so that a post's creation, any later interactions,
+// and the purge of its author's posts are always handled by the same worker, in order.
+// It also tracks which events have been fully processed, so that our position in the Jetstream can be checkpointed.
+type Queue struct {
+	partitions []chan StreamEvent
+	checkpoint *checkpoint
+}
+
+// Create a queue with one partition per worker, dividing the buffer size between them.
+func newQueue(workers, size int) *Queue {
+	partitions := make([]chan StreamEvent, workers)
+	for i := range partitions {
+		partitions[i] = make(chan StreamEvent, max(size/workers, 1))
+	}
+
+	return &Queue{
+		partitions: partitions,
+		checkpoint: &checkpoint{},
+	}
+}
+
+// Push adds an event to the queue, blocking until there is room or the context is cancelled.
+func (q *Queue) Push(ctx context.Context, event StreamEvent) error {
+	event.seq = q.checkpoint.track(event.TimeUS)
+
+	hasher := fnv.New32a()
+	hasher.Write([]byte(partitionKey(event)))
+	partition := q.partitions[hasher.Sum32()%uint32(len(q.partitions))]
+
+	select {
+	case partition <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Partition returns the events assigned to the given worker.
+func (q *Queue) Partition(i int) <-chan StreamEvent {
+	return q.partitions[i]
+}
+
+// Close stops the queue from accepting new events.
+// Workers continue to receive events already in the queue until it is empty.
+func (q *Queue) Close() {
+	for _, partition := range q.partitions {
+		close(partition)
+	}
+}
+
+// Done marks an event as fully processed by a worker.
+func (q *Queue) Done(event StreamEvent) {
+	q.checkpoint.done(event.seq)
+}
+
+// Cursor returns the timestamp of the most recent event for which it, and every event before it, has been processed.
+// Returns zero if no events have been processed.
+func (q *Queue) Cursor() int64 {
+	return q.checkpoint.cursor()
+}
+
+// Saturated determines whether any partition is full, such that pushing an event to it would block.
+func (q *Queue) Saturated() bool {
+	for _, partition := range q.partitions {
+		if len(partition) == cap(partition) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of events waiting to be processed, across all partitions.
+func (q *Queue) Len() int {
+	total := 0
+	for _, partition := range q.partitions {
+		total += len(partition)
+	}
+	return total
+}
+
+// Determine the author of the post an event affects, which is used to assign it to a partition.
+// Interactions affect another author's post, while every other event affects the posts of its own author.
+func partitionKey(event StreamEvent) string {
+	if target, _ := targetPost(event); target != "" {
+		did, _, _ := strings.Cut(strings.TrimPrefix(target, "at://"), "/")
+		return did
+	}
+	return event.DID
+}
+
+// Tracks events in the order they were read from the Jetstream.
+// Events may finish processing out of order, so the checkpoint only advances past contiguous processed events.
+type checkpoint struct {
+	mu      sync.Mutex
+	base    uint64 // Sequence number of the first pending entry
+	next    uint64 // Sequence number assigned to the next event
+	pending []checkpointEntry
+	latest  int64 // Timestamp of the most recent fully-processed event
+}
+
+type checkpointEntry struct {
+	timeUS int64
+	done   bool
+}
+
+func (c *checkpoint) track(timeUS int64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := c.next
+	c.next++
+	c.pending = append(c.pending, checkpointEntry{timeUS: timeUS})
+	return seq
+}
+
+func (c *checkpoint) done(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if seq < c.base || seq-c.base >= uint64(len(c.pending)) {
+		return
+	}
+	c.pending[seq-c.base].done = true
+
+	for len(c.pending) > 0 && c.pending[0].done {
+		c.latest = c.pending[0].timeUS
+		c.pending = c.pending[1:]
+		c.base++
+	}
+}
+
+func (c *checkpoint) cursor() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latest
+}
@@ -0,0 +1,83 @@
+package app
+
+import "testing"
+
+func TestCheckpoint(t *testing.T) {
+	c := checkpoint{}
+	first := c.track(100)
+	second := c.track(200)
+	third := c.track(300)
+
+	if c.cursor() != 0 {
+		t.Errorf("expected no cursor before any event is processed, got %d", c.cursor())
+	}
+
+	// Events finishing out of order must not advance the checkpoint past pending events
+	c.done(second)
+	if c.cursor() != 0 {
+		t.Errorf("expected cursor to wait for the first event, got %d", c.cursor())
+	}
+
+	c.done(first)
+	if c.cursor() != 200 {
+		t.Errorf("expected cursor 200, got %d", c.cursor())
+	}
+
+	c.done(third)
+	if c.cursor() != 300 {
+		t.Errorf("expected cursor 300, got %d", c.cursor())
+	}
+}
+
+func TestQueuePartitioning(t *testing.T) {
+	queue := newQueue(8, 80)
+
+	post := StreamEvent{DID: validDID, TimeUS: 1, Kind: "commit", Commit: Commit{
+		Operation: "create",
+		RKey:      "3lp3ldyiu2k2g",
+		Record:    Record{Type: "app.bsky.feed.post", Text: "Regular post"},
+	}}
+	like := StreamEvent{DID: "did:plc:other", TimeUS: 2, Kind: "commit", Commit: Commit{
+		Operation: "create",
+		Record:    Record{Type: "app.bsky.feed.like", Subject: Content{URI: postURI(post)}},
+	}}
+
+	purge := StreamEvent{DID: validDID, TimeUS: 3, Kind: "account", Account: Account{Active: false}}
+
+	for _, event := range []StreamEvent{post, like, purge} {
+		if err := queue.Push(t.Context(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every event must be assigned to the same worker, in order
+	for i := range 8 {
+		select {
+		case first := <-queue.Partition(i):
+			if queue.Len() != 2 || len(queue.Partition(i)) != 2 {
+				t.Fatal("expected every event to be assigned to the same partition")
+			}
+			second, third := <-queue.Partition(i), <-queue.Partition(i)
+			if first.TimeUS != 1 || second.TimeUS != 2 || third.TimeUS != 3 {
+				t.Errorf("expected events in order, got %d, %d then %d", first.TimeUS, second.TimeUS, third.TimeUS)
+			}
+			return
+		default:
+		}
+	}
+	t.Error("expected events to be assigned to a partition")
+}
+
+func TestQueueSaturated(t *testing.T) {
+	queue := newQueue(1, 1)
+	if queue.Saturated() {
+		t.Error("expected an empty queue not to be saturated")
+	}
+
+	if err := queue.Push(t.Context(), StreamEvent{DID: validDID, TimeUS: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if !queue.Saturated() {
+		t.Error("expected a full queue to be saturated")
+	}
+}
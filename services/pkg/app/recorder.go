@@ -0,0 +1,233 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Recorder writes Jetstream messages to JSONL files, one message per line, for later replay.
+// A new file is started at a regular interval. Files can optionally be compressed with zstd.
+type Recorder struct {
+	mu       sync.Mutex
+	dir      string
+	compress bool
+	rotate   time.Duration
+	file     *os.File
+	writer   io.WriteCloser
+	opened   time.Time
+}
+
+func newRecorder(dir string, compress bool, rotate time.Duration) *Recorder {
+	return &Recorder{
+		dir:      dir,
+		compress: compress,
+		rotate:   rotate,
+	}
+}
+
+// Record appends a message to the current file, starting a new file if it's time to rotate.
+func (r *Recorder) Record(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil || time.Since(r.opened) >= r.rotate {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	// Ensure the message fits on a single line
+	var line bytes.Buffer
+	if err := json.Compact(&line, data); err != nil {
+		return util.WrapErr("failed to compact message", err)
+	}
+	line.WriteByte('\n')
+
+	if _, err := r.writer.Write(line.Bytes()); err != nil {
+		return util.WrapErr("failed to write message", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the current file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.close()
+}
+
+// Start a new file, named after the time it was opened.
+func (r *Recorder) open() error {
+	if err := r.close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return util.WrapErr("failed to create recording directory", err)
+	}
+
+	// Names have sub-second precision, and existing files are never overwritten, so that a quick rotation or restart
+	// starts a new recording rather than replacing the last one.
+	r.opened = time.Now()
+	name := fmt.Sprintf("jetstream-%s.jsonl", r.opened.UTC().Format("20060102T150405.000000000Z"))
+	if r.compress {
+		name += ".zst"
+	}
+
+	file, err := os.OpenFile(filepath.Join(r.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return util.WrapErr("failed to create recording file", err)
+	}
+
+	var writer io.WriteCloser = flushCloser{bufio.NewWriter(file)}
+	if r.compress {
+		encoder, err := zstd.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return util.WrapErr("failed to create zstd encoder", err)
+		}
+		writer = encoder
+	}
+	r.file = file
+	r.writer = writer
+
+	slog.Info("recording jetstream", "file", file.Name())
+	return nil
+}
+
+func (r *Recorder) close() error {
+	if r.file == nil {
+		return nil
+	}
+
+	errWriter := r.writer.Close()
+	errFile := r.file.Close()
+	r.file = nil
+	r.writer = nil
+	if err := errors.Join(errWriter, errFile); err != nil {
+		return util.WrapErr("failed to close recording file", err)
+	}
+	return nil
+}
+
+// Flushes a buffered writer when closed.
+type flushCloser struct {
+	*bufio.Writer
+}
+
+func (n flushCloser) Close() error {
+	return n.Flush()
+}
+
+// Replayer reads a recording made by the Recorder, and pushes its events to the worker queue.
+// Events are replayed at the speed they were recorded, multiplied by the given factor.
+// A speed of zero replays events as fast as the workers can process them.
+// Events are timestamped with the time they're replayed, as if they had just been received from the Jetstream,
+// so that the cache treats them like live posts, rather than expiring those older than the TTL.
+type Replayer struct {
+	path     string
+	speed    float64
+	replayed atomic.Int64
+	cursor   atomic.Int64 // Recorded timestamp of the last event replayed
+}
+
+func newReplayer(path string, speed float64) *Replayer {
+	return &Replayer{
+		path:  path,
+		speed: speed,
+	}
+}
+
+// Run replays the recording, returning once every event has been pushed or the context is cancelled.
+func (r *Replayer) Run(ctx context.Context, queue *Queue) error {
+	file, err := os.Open(r.path)
+	if err != nil {
+		return util.WrapErr("failed to open recording", err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(r.path, ".zst") {
+		decoder, err := zstd.NewReader(file)
+		if err != nil {
+			return util.WrapErr("failed to create zstd decoder", err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	}
+
+	slog.Info("replaying recording", "file", r.path, "speed", r.speed)
+
+	var first int64 // Timestamp of the first event in the recording
+	var started time.Time
+	var last int64 // Replayed timestamp of the previous event
+	lines := bufio.NewReader(reader)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			event, _, decodeErr := decodeEvent(websocket.TextMessage, line, nil)
+			if decodeErr != nil {
+				slog.Warn(decodeErr.Error())
+				continue
+			}
+
+			// Wait until the event is due, relative to the first event
+			if first == 0 {
+				first = event.TimeUS
+				started = time.Now()
+			}
+			if r.speed > 0 {
+				offset := time.Duration(float64(event.TimeUS-first)/r.speed) * time.Microsecond
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(time.Until(started.Add(offset))):
+				}
+			}
+
+			// Events keep their order, even if several are replayed within the same microsecond
+			recorded := event.TimeUS
+			event.TimeUS = max(time.Now().UnixMicro(), last+1)
+			last = event.TimeUS
+
+			if err := queue.Push(ctx, event); err != nil {
+				return nil
+			}
+			r.replayed.Add(1)
+			r.cursor.Store(recorded)
+		}
+
+		if err == io.EOF {
+			slog.Info("finished replaying recording", "events", r.replayed.Load())
+			return nil
+		}
+		if err != nil {
+			return util.WrapErr("failed to read recording", err)
+		}
+	}
+}
+
+// LogValue summarizes replay progress for the periodic intake stats.
+func (r *Replayer) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("file", r.path),
+		slog.Int64("replayed", r.replayed.Load()),
+		slog.Int64("cursor", r.cursor.Load()),
+	)
+}
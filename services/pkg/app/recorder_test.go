@@ -0,0 +1,115 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	files := []string{"standard-post.json", "like.json", "delete-post.json"}
+
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		recorder := newRecorder(dir, compress, time.Hour)
+		for _, file := range files {
+			data, err := os.ReadFile("../../sample-data/" + file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := recorder.Record(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := recorder.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		recordings, err := filepath.Glob(filepath.Join(dir, "jetstream-*"))
+		if err != nil || len(recordings) != 1 {
+			t.Fatalf("expected a single recording, got %v", recordings)
+		}
+
+		// Replay as fast as possible, and expect the same events in the same order, timestamped when they were replayed
+		previous := time.Now().UnixMicro() - 1
+		queue := newQueue(1, len(files))
+		replayer := newReplayer(recordings[0], 0)
+		if err := replayer.Run(t.Context(), queue); err != nil {
+			t.Fatal(err)
+		}
+		if queue.Len() != len(files) {
+			t.Fatalf("expected %d events, got %d", len(files), queue.Len())
+		}
+		for _, file := range files {
+			expected := sampleEvent(t, file)
+			event := <-queue.Partition(0)
+			if event.TimeUS <= previous || event.Commit.RKey != expected.Commit.RKey {
+				t.Errorf("compress=%v: expected event from %s, got %+v", compress, file, event)
+			}
+			previous = event.TimeUS
+		}
+	}
+}
+
+func TestRecorderRotate(t *testing.T) {
+	dir := t.TempDir()
+	recorder := newRecorder(dir, false, 0)
+	data, err := os.ReadFile("../../sample-data/standard-post.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating in quick succession must start a new file each time, rather than overwriting the last
+	for range 3 {
+		if err := recorder.Record(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recordings, err := filepath.Glob(filepath.Join(dir, "jetstream-*"))
+	if err != nil || len(recordings) != 3 {
+		t.Fatalf("expected three recordings, got %v", recordings)
+	}
+}
+
+func TestReplayIntake(t *testing.T) {
+	dir := t.TempDir()
+	recorder := newRecorder(dir, false, time.Hour)
+	data, err := os.ReadFile("../../sample-data/standard-post.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Record(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	recordings, err := filepath.Glob(filepath.Join(dir, "jetstream-*"))
+	if err != nil || len(recordings) != 1 {
+		t.Fatalf("expected a single recording, got %v", recordings)
+	}
+
+	cfg := testConfig()
+	cfg.WorkerPoolSize = 1
+	cfg.StreamBufferSize = 10
+	cfg.ShutdownTimeout = 5 * time.Second
+	cfg.CursorTTL = time.Hour
+	cfg.ReplayPath = recordings[0]
+	store := cache.NewMemory(cfg)
+
+	// The recording is older than the cache's TTL, but its posts are still saved
+	if err := runIntake(t.Context(), App{Config: cfg, Cache: store}); err != nil {
+		t.Fatal(err)
+	}
+	if !saved(store, util.Hash("at://did:plc:ruzlll5u7u7pfxybmppqyxbx/app.bsky.feed.post/3lp3ldyiu2k2g")) {
+		t.Error("expected replayed post to be saved")
+	}
+}
@@ -1,17 +1,20 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
 )
 
-func Server() error {
+func Server(ctx context.Context) error {
 	slog.Info("starting server")
 
 	app, err := NewApp()
@@ -20,9 +23,16 @@ func Server() error {
 	}
 	defer app.Close()
 
+	return runServer(ctx, app)
+}
+
+// Serve the feed until the context is cancelled.
+func runServer(ctx context.Context, app App) error {
 	// Update Cloudflare DNS records
-	if err := updateServiceDNS(app.Config); err != nil {
-		slog.Error(util.WrapErr("failed to update dns", err).Error())
+	if app.Config.DNSUpdateEnabled {
+		if err := updateServiceDNS(app.Config); err != nil {
+			slog.Error(util.WrapErr("failed to update dns", err).Error())
+		}
 	}
 
 	server := http.NewServeMux()
@@ -50,7 +60,9 @@ func Server() error {
 	})
 
 	// Serve the feed by supplying a list of AT URIs of "lonely posts".
-	// Read a random set of ten posts from the cache.
+	// Read a page of posts from the cache, newest first. The cursor is the timestamp of the last post on the previous page.
+	// The feed determines which posts are included, by default those with no interactions. Optional query parameters narrow
+	// the posts further, such as to only those older than 30 minutes, or only short posts.
 	server.HandleFunc("/xrpc/app.bsky.feed.getFeedSkeleton", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "public; max-age=15")
@@ -58,7 +70,7 @@ func Server() error {
 		slog.Info("request", "limit", r.URL.Query().Get("limit"), "cursor", r.URL.Query().Get("cursor"))
 
 		// Fetch post records from the cache
-		posts, respCursor, err := app.Cache.ReadPosts(limitQuery(r), cursorQuery(r))
+		posts, respCursor, err := app.Cache.ReadPosts(limitQuery(r), cursorQuery(r), criteriaQuery(r))
 		if err != nil {
 			slog.Error("failed to find posts", "error", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -74,8 +86,32 @@ func Server() error {
 		}
 	})
 
-	slog.Info("starting server", "port", app.Config.ServerPort)
-	return http.ListenAndServe(fmt.Sprintf(":%s", app.Config.ServerPort), server)
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%s", app.Config.ServerPort),
+		Handler: server,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "port", app.Config.ServerPort)
+		errs <- httpServer.ListenAndServe()
+	}()
+
+	// Serve requests until we're signalled to stop, then allow in-flight requests to finish
+	select {
+	case err := <-errs:
+		return util.WrapErr("server exited", err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("stopping server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.Config.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return util.WrapErr("failed to shut down server", err)
+	}
+
+	return nil
 }
 
 func limitQuery(r *http.Request) int {
@@ -110,6 +146,49 @@ func cursorQuery(r *http.Request) uint64 {
 	return cursor
 }
 
+// Feeds served alongside the lonely posts feed, keyed by the record key of their feed generator record.
+// Any other feed serves posts with no interactions.
+var feeds = map[string]cache.Criteria{
+	"almost-lonely": {MaxInteractions: cache.Interactions{Likes: 1}}, // Posts with at most one like, and nothing else
+}
+
+// Parse the criteria for which posts to include, starting from those of the requested feed. Invalid values are ignored.
+//   - minAge: only posts at least this old, as a duration (e.g. '30m')
+//   - maxLength: only posts with at most this many characters
+//   - lang: only posts in one of these languages (may be repeated)
+//   - minScore: only posts with at least this filter score, from zero to one
+//   - maxLikes, maxReposts, maxQuotes, maxReplies: only posts with at most this many interactions of each kind
+func criteriaQuery(r *http.Request) cache.Criteria {
+	query := r.URL.Query()
+	feed := query.Get("feed")
+	criteria := feeds[feed[strings.LastIndex(feed, "/")+1:]]
+	if minAge, err := time.ParseDuration(query.Get("minAge")); err == nil {
+		criteria.MinAge = minAge
+	}
+	if maxLength, err := strconv.Atoi(query.Get("maxLength")); err == nil && maxLength > 0 {
+		criteria.MaxTextLength = maxLength
+	}
+	if minScore, err := strconv.ParseFloat(query.Get("minScore"), 64); err == nil {
+		criteria.MinScore = minScore
+	}
+	if langs := query["lang"]; len(langs) > 0 {
+		criteria.Languages = langs
+	}
+
+	for param, limit := range map[string]*int{
+		"maxLikes":   &criteria.MaxInteractions.Likes,
+		"maxReposts": &criteria.MaxInteractions.Reposts,
+		"maxQuotes":  &criteria.MaxInteractions.Quotes,
+		"maxReplies": &criteria.MaxInteractions.Replies,
+	} {
+		if value, err := strconv.Atoi(query.Get(param)); err == nil && value >= 0 {
+			*limit = value
+		}
+	}
+
+	return criteria
+}
+
 func toResponse(posts []cache.PostRecord, cursor uint64) APIFeedSkeletonResponse {
 	feed := make([]APIPost, len(posts))
 	for i, post := range posts {
@@ -118,7 +197,7 @@ func toResponse(posts []cache.PostRecord, cursor uint64) APIFeedSkeletonResponse
 		}
 	}
 	cursorStr := strconv.FormatUint(cursor, 10)
-	if cursorStr == "0" || len(posts) == 0 {
+	if cursorStr == "0" {
 		cursorStr = "" // Ensure cursor is omitted from response if no more posts are available
 	}
 
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+// Standalone runs the intake and server in a single process, sharing one cache.
+// This suits small deployments, and is required by caches that can't be shared between processes.
+// If either stops unexpectedly, the other is stopped too.
+func Standalone(ctx context.Context) error {
+	slog.Info("starting standalone")
+
+	app, err := NewApp()
+	if err != nil {
+		return util.WrapErr("failed to create app", err)
+	}
+	defer app.Close()
+
+	return runStandalone(ctx, app)
+}
+
+func runStandalone(ctx context.Context, app App) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	intakeErr := make(chan error, 1)
+	go func() {
+		defer cancel()
+		intakeErr <- runIntake(ctx, app)
+	}()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		defer cancel()
+		serverErr <- runServer(ctx, app)
+	}()
+
+	// Wait for both to stop before the cache is closed
+	var errs []error
+	if err := <-intakeErr; err != nil {
+		errs = append(errs, util.WrapErr("intake stopped", err))
+	}
+	if err := <-serverErr; err != nil {
+		errs = append(errs, util.WrapErr("server stopped", err))
+	}
+	return errors.Join(errs...)
+}
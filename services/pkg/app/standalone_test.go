@@ -0,0 +1,57 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/cache"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/jetstreamtest"
+)
+
+func TestStandalone(t *testing.T) {
+	jetstream := jetstreamtest.NewServer()
+	defer jetstream.Close()
+
+	cfg := testConfig(jetstream.URL())
+	cfg.WorkerPoolSize = 1
+	cfg.StreamBufferSize = 10
+	cfg.CursorCheckpoint = time.Hour
+	cfg.CursorTTL = time.Hour
+	cfg.ShutdownTimeout = 5 * time.Second
+	cfg.ServerPort = "0"
+	app := App{Config: cfg, Cache: cache.NewMemory(cfg)}
+
+	// Stopping the process stops both the intake and server
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() { done <- runStandalone(ctx, app) }()
+	if !jetstream.AwaitSubscriber(5 * time.Second) {
+		t.Fatal("intake did not connect to the jetstream")
+	}
+	cancel()
+	if err := awaitResult(t, done); err != nil {
+		t.Fatal(err)
+	}
+
+	// If the server fails, the intake is stopped too
+	app.Config.ServerPort = "-1"
+	go func() { done <- runStandalone(t.Context(), app) }()
+	err := awaitResult(t, done)
+	if err == nil || !strings.Contains(err.Error(), "server stopped") {
+		t.Fatalf("expected server error, got %v", err)
+	}
+}
+
+func awaitResult(t *testing.T, done chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for standalone to stop")
+		return nil
+	}
+}
@@ -5,19 +5,38 @@ import (
 )
 
 // StreamEvent (and subtypes) represent a message from the Jetstream.
-// Fields for both posts and reposts are included.
+// Fields for both posts and reposts are included, as well as account status changes.
 type StreamEvent struct {
-	DID    string `json:"did"`
-	TimeUS int64  `json:"time_us"`
-	Kind   string `json:"kind"`
-	Commit Commit `json:"commit"`
+	DID      string   `json:"did"`
+	TimeUS   int64    `json:"time_us"`
+	Kind     string   `json:"kind"`
+	Commit   Commit   `json:"commit"`
+	Account  Account  `json:"account"`
+	Identity Identity `json:"identity"`
+
+	seq uint64 // Position in the intake queue, used for checkpointing
 }
 
 type Commit struct {
-	Operation string `json:"operation"`
-	Record    Record `json:"record"`
-	RKey      string `json:"rkey"`
-	CID       string `json:"cid"`
+	Operation  string `json:"operation"`
+	Collection string `json:"collection"`
+	Record     Record `json:"record"`
+	RKey       string `json:"rkey"`
+	CID        string `json:"cid"`
+}
+
+// Account events are sent when an account's hosting status changes.
+// The status is one of 'deactivated', 'suspended', 'takendown' or 'deleted' when the account is inactive.
+type Account struct {
+	Active bool   `json:"active"`
+	DID    string `json:"did"`
+	Status string `json:"status"`
+}
+
+// Identity events are sent when an account's handle or DID document changes.
+type Identity struct {
+	DID    string `json:"did"`
+	Handle string `json:"handle"`
 }
 
 type Record struct {
@@ -78,10 +97,17 @@ type Content struct {
 }
 
 // Valid determines whether a stream event should be processed by our application.
+// Identity events are always ignored, as they don't affect whether posts can be displayed.
 func (s *StreamEvent) Valid() bool {
+	if s.IsInactiveAccount() {
+		return true
+	}
 	if s.Kind != "commit" {
 		return false
 	}
+	if s.IsPostDeletion() {
+		return true
+	}
 	if s.Commit.Operation != "create" {
 		return false
 	}
@@ -105,6 +131,18 @@ func (s *StreamEvent) IsPost() bool {
 	return s.Commit.Record.Type == "app.bsky.feed.post"
 }
 
+// IsPostDeletion determines whether the author deleted one of their posts.
+// Deletions don't include a record, so the collection is used to identify posts.
+func (s *StreamEvent) IsPostDeletion() bool {
+	return s.Commit.Operation == "delete" && s.Commit.Collection == "app.bsky.feed.post"
+}
+
+// IsInactiveAccount determines whether an account was deactivated, suspended or taken down.
+// Posts from inactive accounts can no longer be displayed in a feed.
+func (s *StreamEvent) IsInactiveAccount() bool {
+	return s.Kind == "account" && !s.Account.Active
+}
+
 func (s *StreamEvent) IsQuotePost() bool {
 	if !s.IsPost() {
 		return false
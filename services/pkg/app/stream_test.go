@@ -0,0 +1,67 @@
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		valid    bool
+		deletion bool
+		inactive bool
+	}{
+		{name: "standard post", file: "standard-post.json", valid: true},
+		{name: "like", file: "like.json", valid: true},
+		{name: "post deletion", file: "delete-post.json", valid: true, deletion: true},
+		{name: "account taken down", file: "account-takendown.json", valid: true, inactive: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event := sampleEvent(t, test.file)
+			if event.Valid() != test.valid {
+				t.Errorf("expected valid to be %v", test.valid)
+			}
+			if event.IsPostDeletion() != test.deletion {
+				t.Errorf("expected deletion to be %v", test.deletion)
+			}
+			if event.IsInactiveAccount() != test.inactive {
+				t.Errorf("expected inactive account to be %v", test.inactive)
+			}
+		})
+	}
+
+	// Deleting a like is not a post deletion, and should be ignored
+	like := sampleEvent(t, "like.json")
+	like.Commit.Operation = "delete"
+	like.Commit.Record = Record{}
+	if like.Valid() || like.IsPostDeletion() {
+		t.Error("expected like deletion to be ignored")
+	}
+
+	// Reactivated accounts should be ignored
+	account := sampleEvent(t, "account-takendown.json")
+	account.Account.Active = true
+	account.Account.Status = ""
+	if account.Valid() {
+		t.Error("expected active account to be ignored")
+	}
+}
+
+func sampleEvent(t *testing.T, file string) StreamEvent {
+	t.Helper()
+
+	data, err := os.ReadFile("../../sample-data/" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event StreamEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
@@ -0,0 +1,475 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/vmihailenco/msgpack/v5"
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltSweepInterval = time.Minute
+
+// Buckets used by the Bolt cache.
+// Posts are ordered by timestamp, which is the order they are paginated and expired in.
+// The other buckets index the posts by hash and author, and hold their interaction counts.
+var (
+	postsBucket        = []byte("posts")        // Timestamp + post hash -> post record
+	hashesBucket       = []byte("hashes")       // Post hash -> key in the posts bucket
+	authorsBucket      = []byte("authors")      // Author DID + post hash -> nothing
+	interactionsBucket = []byte("interactions") // Post hash -> interaction counts
+	metaBucket         = []byte("meta")         // 'cursor' -> cursor + expiry time
+)
+
+var cursorMetaKey = []byte("cursor")
+
+// Bolt is a cache backed by an embedded, on-disk bbolt database, with the same expiry and lonely-age semantics as Valkey.
+// The database file can only be opened by one process at a time, so the intake and server must run in the same process.
+type Bolt struct {
+	db        *bolt.DB
+	cursorTTL time.Duration
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// NewBolt opens (or creates) the database file, and starts periodically removing expired posts.
+func NewBolt(cfg config.Config) (*Bolt, error) {
+	db, err := bolt.Open(cfg.BoltPath, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, util.WrapErr("failed to open bolt database", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{postsBucket, hashesBucket, authorsBucket, interactionsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, util.WrapErr("failed to create buckets", err)
+	}
+
+	b := &Bolt{
+		db:        db,
+		cursorTTL: cfg.CursorTTL,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go b.sweepExpired()
+	return b, nil
+}
+
+// SavePost saves a post record, expiring it relative to when the post was created.
+// The post is also added to an index of its author's posts, so that they can be purged if the account becomes inactive.
+// Saving a post that's already cached keeps its interaction counts.
+func (b *Bolt) SavePost(hash string, post PostRecord) error {
+	return b.Apply([]Op{SaveOp(hash, post)})
+}
+
+// Apply performs a batch of writes in a single transaction, in order.
+func (b *Bolt) Apply(ops []Op) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			var err error
+			switch op.Kind {
+			case OpSave:
+				err = putPost(tx, op.Hash, op.Post)
+			case OpDelete:
+				_, err = deletePost(tx, op.Hash)
+			case OpInteract:
+				err = interactPost(tx, op.Hash, op.Interaction, op.Timestamp)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return util.WrapErr("failed to apply batch", err)
+	}
+	return nil
+}
+
+// ReadPost reads a post record. If the record does not exist or has expired, return an empty record.
+func (b *Bolt) ReadPost(hash string) (PostRecord, error) {
+	var record PostRecord
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = readPost(tx, hash)
+		return err
+	})
+	if err != nil {
+		return PostRecord{}, util.WrapErr("failed to read post", err)
+	}
+
+	if time.Now().After(postExpiry(record)) {
+		return PostRecord{}, nil
+	}
+	return record, nil
+}
+
+// ReadPosts returns up to 'n' posts, newest first, starting at the given cursor.
+// Only posts older than X minutes are included, to ensure a given post truly is "lonely".
+// The cursor is the timestamp of the last post returned, and the next page continues with older posts.
+// A cursor of zero starts from the newest lonely post, and is returned once there are no more posts.
+// Only posts that meet the criteria are returned.
+func (b *Bolt) ReadPosts(n int, cursor uint64, criteria Criteria) ([]PostRecord, uint64, error) {
+	result := make([]PostRecord, 0, n)
+	var next uint64
+	now := time.Now()
+	newest := criteria.Newest(now)
+	if cursor > 0 && cursor <= uint64(newest) {
+		newest = int64(cursor) - 1 // Exclusive, as the post at the cursor was on the previous page
+	}
+	oldest := now.Add(-time.Second * TTLSeconds).UnixMicro()
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// Seek to the first post after the newest eligible timestamp, then step backwards
+		c := tx.Bucket(postsBucket).Cursor()
+		k, v := c.Seek(postKey(newest+1, ""))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+
+		for ; k != nil && postTimestamp(k) >= oldest; k, v = c.Prev() {
+			if len(result) >= n {
+				next = uint64(result[len(result)-1].Timestamp)
+				return nil
+			}
+
+			record, err := decodeRecord(v)
+			if errors.Is(err, errNewerRecord) {
+				slog.Warn("skipping post written by a newer version", "hash", string(k[8:]), "error", err.Error())
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			counts, err := readCounts(tx, string(k[8:]))
+			if err != nil {
+				return err
+			}
+			record = record.withCounts(counts)
+			if criteria.Match(record) {
+				result = append(result, record)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, util.WrapErr("failed to read posts", err)
+	}
+
+	return result, next, nil
+}
+
+// Interact counts an interaction with a post, if it's cached.
+func (b *Bolt) Interact(hash string, kind InteractionKind, timestamp int64) error {
+	return b.Apply([]Op{InteractOp(hash, kind, timestamp)})
+}
+
+// DeletePost deletes a post record.
+func (b *Bolt) DeletePost(hash string) error {
+	return b.Apply([]Op{DeleteOp(hash)})
+}
+
+// DeleteAuthorPosts deletes every post by the given author, returning the number of posts deleted.
+func (b *Bolt) DeleteAuthorPosts(did string) (int, error) {
+	deleted := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		prefix := authorIndexKey(did, "")
+		var hashes []string
+		c := tx.Bucket(authorsBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			hashes = append(hashes, string(k[len(prefix):]))
+		}
+
+		for _, hash := range hashes {
+			ok, err := deletePost(tx, hash)
+			if err != nil {
+				return err
+			}
+			if ok {
+				deleted++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, util.WrapErr("failed to delete author posts", err)
+	}
+
+	return deleted, nil
+}
+
+// Migrate rewrites every post record stored in a previous version in the current version, returning the number rewritten.
+func (b *Bolt) Migrate(ctx context.Context) (int, error) {
+	migrated := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		// The bucket can't be modified while iterating over it, so collect the rewritten records first
+		posts := tx.Bucket(postsBucket)
+		rewritten := make(map[string][]byte)
+		err := posts.ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			data, err := migrateRecord(v)
+			if data != nil {
+				rewritten[string(k)] = data
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, data := range rewritten {
+			if err := posts.Put([]byte(k), data); err != nil {
+				return err
+			}
+		}
+		migrated = len(rewritten)
+		return nil
+	})
+	if err != nil {
+		return 0, util.WrapErr("failed to migrate posts", err)
+	}
+	return migrated, nil
+}
+
+// SaveCursor saves the Jetstream cursor, which expires after the configured TTL.
+func (b *Bolt) SaveCursor(cursor int64) error {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value, uint64(cursor))
+	binary.BigEndian.PutUint64(value[8:], uint64(time.Now().Add(b.cursorTTL).Unix()))
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(cursorMetaKey, value)
+	})
+	if err != nil {
+		return util.WrapErr("failed to save cursor", err)
+	}
+	return nil
+}
+
+// ReadCursor reads the Jetstream cursor, returning zero if none has been saved or it has expired.
+func (b *Bolt) ReadCursor() (int64, error) {
+	var cursor int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucket).Get(cursorMetaKey)
+		if len(value) != 16 {
+			return nil
+		}
+		if time.Now().Unix() < int64(binary.BigEndian.Uint64(value[8:])) {
+			cursor = int64(binary.BigEndian.Uint64(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, util.WrapErr("failed to read cursor", err)
+	}
+	return cursor, nil
+}
+
+// Close stops removing expired posts, and closes the database.
+func (b *Bolt) Close() {
+	close(b.stop)
+	<-b.stopped
+	if err := b.db.Close(); err != nil {
+		slog.Error(util.WrapErr("failed to close bolt database", err).Error())
+	}
+}
+
+// Periodically remove expired posts until the cache is closed.
+func (b *Bolt) sweepExpired() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(boltSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			removed, err := b.sweep(time.Now())
+			if err != nil {
+				slog.Error(util.WrapErr("failed to remove expired posts", err).Error())
+				continue
+			}
+			slog.Debug("removed expired posts", "count", removed)
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Remove every post that expired before the given time, returning the number removed.
+func (b *Bolt) sweep(now time.Time) (int, error) {
+	removed := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		oldest := now.Add(-time.Second * TTLSeconds).UnixMicro()
+		var hashes []string
+		c := tx.Bucket(postsBucket).Cursor()
+		for k, _ := c.First(); k != nil && postTimestamp(k) < oldest; k, _ = c.Next() {
+			hashes = append(hashes, string(k[8:]))
+		}
+
+		for _, hash := range hashes {
+			ok, err := deletePost(tx, hash)
+			if err != nil {
+				return err
+			}
+			if ok {
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// Save a post and its index entries.
+func putPost(tx *bolt.Tx, hash string, post PostRecord) error {
+	if time.Until(postExpiry(post)) <= 0 {
+		return nil
+	}
+
+	// An overwritten post keeps its interaction counts.
+	// It may have a different timestamp, so it's removed from its previous position.
+	counts := bytes.Clone(tx.Bucket(interactionsBucket).Get([]byte(hash)))
+	if _, err := deletePost(tx, hash); err != nil {
+		return err
+	}
+	if counts != nil {
+		if err := tx.Bucket(interactionsBucket).Put([]byte(hash), counts); err != nil {
+			return err
+		}
+	}
+
+	data, err := encodeRecord(post)
+	if err != nil {
+		return err
+	}
+	key := postKey(post.Timestamp, hash)
+	if err := tx.Bucket(postsBucket).Put(key, data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(hashesBucket).Put([]byte(hash), key); err != nil {
+		return err
+	}
+	return tx.Bucket(authorsBucket).Put(authorIndexKey(post.AuthorDID(), hash), nil)
+}
+
+// Count an interaction with a post, if it exists. The record is left untouched, as the counts are stored separately.
+func interactPost(tx *bolt.Tx, hash string, kind InteractionKind, timestamp int64) error {
+	if tx.Bucket(hashesBucket).Get([]byte(hash)) == nil {
+		return nil
+	}
+
+	counts, err := readCounts(tx, hash)
+	if err != nil {
+		return err
+	}
+	data, err := msgpack.Marshal(counts.add(kind, timestamp))
+	if err != nil {
+		return util.WrapErr("failed to marshal interactions", err)
+	}
+	return tx.Bucket(interactionsBucket).Put([]byte(hash), data)
+}
+
+// Read a post record with its interaction counts, returning an empty record if it doesn't exist,
+// or was written by a newer version.
+func readPost(tx *bolt.Tx, hash string) (PostRecord, error) {
+	key := tx.Bucket(hashesBucket).Get([]byte(hash))
+	if key == nil {
+		return PostRecord{}, nil
+	}
+	record, err := decodeRecord(tx.Bucket(postsBucket).Get(key))
+	if errors.Is(err, errNewerRecord) {
+		slog.Warn("skipping post written by a newer version", "hash", hash, "error", err.Error())
+		return PostRecord{}, nil
+	}
+	if err != nil {
+		return PostRecord{}, err
+	}
+	counts, err := readCounts(tx, hash)
+	if err != nil {
+		return PostRecord{}, err
+	}
+	return record.withCounts(counts), nil
+}
+
+// Read a post's interaction counts, which are zero if there have been none.
+func readCounts(tx *bolt.Tx, hash string) (interactionCounts, error) {
+	var counts interactionCounts
+	data := tx.Bucket(interactionsBucket).Get([]byte(hash))
+	if data == nil {
+		return counts, nil
+	}
+	if err := msgpack.Unmarshal(data, &counts); err != nil {
+		return interactionCounts{}, util.WrapErr("failed to unmarshal interactions", err)
+	}
+	return counts, nil
+}
+
+// Delete a post and its index entries, returning whether it existed.
+func deletePost(tx *bolt.Tx, hash string) (bool, error) {
+	hashes := tx.Bucket(hashesBucket)
+	key := hashes.Get([]byte(hash))
+	if key == nil {
+		return false, nil
+	}
+	key = bytes.Clone(key) // Only valid until the bucket is modified
+
+	posts := tx.Bucket(postsBucket)
+	record, err := decodeRecord(posts.Get(key))
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Bucket(authorsBucket).Delete(authorIndexKey(record.AuthorDID(), hash)); err != nil {
+		return false, err
+	}
+	if err := posts.Delete(key); err != nil {
+		return false, err
+	}
+	if err := hashes.Delete([]byte(hash)); err != nil {
+		return false, err
+	}
+	if err := tx.Bucket(interactionsBucket).Delete([]byte(hash)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Posts expire relative to when they were created.
+func postExpiry(post PostRecord) time.Time {
+	return time.UnixMicro(post.Timestamp).Add(time.Second * TTLSeconds)
+}
+
+// Keys in the posts bucket are ordered by timestamp, then by hash.
+func postKey(timestamp int64, hash string) []byte {
+	key := make([]byte, 8, 8+len(hash))
+	binary.BigEndian.PutUint64(key, uint64(timestamp))
+	return append(key, hash...)
+}
+
+func postTimestamp(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key))
+}
+
+// DIDs never contain a null byte, so it separates the DID from the hash.
+func authorIndexKey(did, hash string) []byte {
+	return []byte(did + "\x00" + hash)
+}
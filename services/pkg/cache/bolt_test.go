@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltReadPosts(t *testing.T) {
+	testReadPosts(t, openBolt(t, filepath.Join(t.TempDir(), "cache.db")))
+}
+
+func TestBoltReadPostsCriteria(t *testing.T) {
+	testReadPostsCriteria(t, openBolt(t, filepath.Join(t.TempDir(), "cache.db")))
+}
+
+func TestBoltInteract(t *testing.T) {
+	testInteract(t, openBolt(t, filepath.Join(t.TempDir(), "cache.db")))
+}
+
+func TestBoltInteractionsStoredSeparately(t *testing.T) {
+	b := openBolt(t, filepath.Join(t.TempDir(), "cache.db"))
+	uri := "at://did:plc:a/app.bsky.feed.post/1"
+	timestamp := time.Now().UnixMicro()
+	savePost(t, b, uri, timestamp)
+	b.Interact(util.Hash(uri), Like, timestamp)
+
+	// The record itself doesn't change, like in Valkey
+	err := b.db.View(func(tx *bolt.Tx) error {
+		stored, err := decodeStored(tx.Bucket(postsBucket).Get(postKey(timestamp, util.Hash(uri))))
+		if err == nil && stored.Interactions.Likes != 0 {
+			t.Errorf("expected counts not to be stored in the record, got %+v", stored)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post, _ := b.ReadPost(util.Hash(uri)); post.Interactions.Likes != 1 {
+		t.Errorf("expected post with 1 like, got %+v", post)
+	}
+}
+
+func TestBoltDeleteAuthorPosts(t *testing.T) {
+	testDeleteAuthorPosts(t, openBolt(t, filepath.Join(t.TempDir(), "cache.db")))
+}
+
+func TestBoltSweep(t *testing.T) {
+	b := openBolt(t, filepath.Join(t.TempDir(), "cache.db"))
+	old := time.Now().Add(-time.Hour)
+	savePost(t, b, "at://did:plc:a/app.bsky.feed.post/1", old.UnixMicro())
+	savePost(t, b, "at://did:plc:a/app.bsky.feed.post/2", time.Now().UnixMicro())
+
+	// Sweep as if the first post has expired, but not the second
+	removed, err := b.sweep(old.Add(time.Second * (TTLSeconds + 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 post removed, got %d", removed)
+	}
+	if deleted, _ := b.DeleteAuthorPosts("did:plc:a"); deleted != 1 {
+		t.Errorf("expected expired post to be removed from author index, got %d posts", deleted)
+	}
+}
+
+func TestBoltPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	uri := "at://did:plc:a/app.bsky.feed.post/1"
+
+	b, err := NewBolt(config.Config{BoltPath: path, CursorTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	savePost(t, b, uri, time.Now().UnixMicro())
+	if err := b.SaveCursor(1000); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// Posts and the cursor survive reopening the database
+	b = openBolt(t, path)
+	if post, _ := b.ReadPost(util.Hash(uri)); post.AtURI != uri {
+		t.Errorf("expected post %s, got %+v", uri, post)
+	}
+	if cursor, _ := b.ReadCursor(); cursor != 1000 {
+		t.Errorf("expected cursor 1000, got %d", cursor)
+	}
+}
+
+func openBolt(t *testing.T, path string) *Bolt {
+	t.Helper()
+
+	b, err := NewBolt(config.Config{BoltPath: path, CursorTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+	return b
+}
@@ -2,6 +2,11 @@ package cache
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
 
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
@@ -11,30 +16,119 @@ import (
 const TTLSeconds = 3600 + (LonelyMinutes * 60) // 1 hour + delay
 const LonelyMinutes = 15                       // 15 minutes
 
+var (
+	errNotCluster      = errors.New("valkey is not running in cluster mode")
+	errClusterReplicas = errors.New("read replicas are not supported in cluster mode")
+)
+
 type Valkey struct {
-	client valkey.Client
+	client    valkey.Client
+	replicas  *replicas // Nil if posts are read from the primary
+	cursorTTL time.Duration
+	cacheTTL  time.Duration // How long post records are cached client-side
+	prefix    string        // Namespace for post keys, empty for the live feed
 }
 
 // New creates a new Valkey client.
 func New(cfg config.Config) (Valkey, error) {
+	option, err := clientOption(cfg)
+	if err != nil {
+		return Valkey{}, err
+	}
+
+	client, err := valkey.NewClient(option)
+	if err != nil {
+		return Valkey{}, util.WrapErr("failed to create valkey client", err)
+	}
+
+	// A single seed address falls back to a standalone client if the server isn't a cluster, so check it really is
+	if cfg.ValkeyMode == "cluster" && client.Mode() != valkey.ClientModeCluster {
+		client.Close()
+		return Valkey{}, errNotCluster
+	}
+
+	v := Valkey{client: client, cursorTTL: cfg.CursorTTL, cacheTTL: cfg.ValkeyClientCacheTTL}
+	if len(cfg.ValkeyReadAddresses) > 0 {
+		if client.Mode() == valkey.ClientModeCluster {
+			client.Close()
+			return Valkey{}, errClusterReplicas
+		}
+		v.replicas, err = newReplicas(cfg.ValkeyReadAddresses, option, cfg.ValkeyReplicaMaxLag)
+		if err != nil {
+			client.Close()
+			return Valkey{}, err
+		}
+	}
+
+	return v, nil
+}
+
+// Build the client options for the configured deployment.
+// In 'auto' and 'cluster' modes, the addresses are cluster seed nodes. In 'sentinel' mode, they are the sentinels.
+func clientOption(cfg config.Config) (valkey.ClientOption, error) {
 	var tlsConfig *tls.Config // nil by default
 	if cfg.ValkeyTLSEnabled {
 		tlsConfig = &tls.Config{
 			InsecureSkipVerify: false, // Validate the server's certificate
 		}
+		if cfg.ValkeyCACert != "" {
+			pem, err := os.ReadFile(cfg.ValkeyCACert)
+			if err != nil {
+				return valkey.ClientOption{}, util.WrapErr("failed to read ca bundle", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return valkey.ClientOption{}, fmt.Errorf("no certificates found in ca bundle %s", cfg.ValkeyCACert)
+			}
+		}
 	}
 
-	client, err := valkey.NewClient(valkey.ClientOption{
-		InitAddress: []string{cfg.ValkeyAddress},
-		TLSConfig:   tlsConfig,
-	})
-	if err != nil {
-		return Valkey{}, util.WrapErr("failed to create valkey client", err)
+	// Post records read by the server are cached client-side, and Valkey notifies us when they change or are deleted.
+	// This requires RESP3 and client tracking, so it can be disabled for servers that don't support it.
+	option := valkey.ClientOption{
+		InitAddress:  cfg.ValkeyAddresses,
+		Username:     cfg.ValkeyUsername,
+		Password:     cfg.ValkeyPassword,
+		TLSConfig:    tlsConfig,
+		DisableCache: !cfg.ValkeyClientCache,
+	}
+
+	switch cfg.ValkeyMode {
+	case "auto", "cluster":
+		// The client discovers whether the server is a cluster, and its topology, from the seed addresses
+	case "single":
+		option.ForceSingleClient = true
+	case "sentinel":
+		if cfg.ValkeySentinelMaster == "" {
+			return valkey.ClientOption{}, errors.New("sentinel mode requires a master set name")
+		}
+		option.Sentinel = valkey.SentinelOption{
+			MasterSet: cfg.ValkeySentinelMaster,
+			Username:  cfg.ValkeySentinelUsername,
+			Password:  cfg.ValkeySentinelPassword,
+			TLSConfig: tlsConfig,
+		}
+	default:
+		return valkey.ClientOption{}, fmt.Errorf("unknown valkey mode %s", cfg.ValkeyMode)
 	}
 
-	return Valkey{client: client}, nil
+	return option, nil
 }
 
 func (v Valkey) Close() {
+	if v.replicas != nil {
+		v.replicas.close()
+	}
 	v.client.Close()
 }
+
+// Return the client that posts are read from: a healthy replica if there is one, otherwise the primary.
+// Writes, and reads that must see the latest writes (such as the cursor), always use the primary.
+func (v Valkey) reader() valkey.Client {
+	if v.replicas != nil {
+		if client, ok := v.replicas.client(); ok {
+			return client
+		}
+	}
+	return v.client
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+)
+
+func TestNewAuth(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireUserAuth("feed", "secret")
+
+	cfg := valkeyConfig(server.Addr(), "single")
+	cfg.ValkeyUsername = "feed"
+	cfg.ValkeyPassword = "secret"
+	v, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if err := v.SaveCursor(1); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.ValkeyPassword = "wrong"
+	if v, err := New(cfg); err == nil {
+		v.Close()
+		t.Error("expected an error with the wrong password")
+	}
+}
+
+// The stand-in reports itself as a single-node cluster, so every key is routed by slot as it would be on a real cluster.
+func TestNewCluster(t *testing.T) {
+	v, err := New(valkeyConfig(miniredis.RunT(t).Addr(), "cluster"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	testDeleteAuthorPosts(t, v)
+}
+
+func TestNewSentinelRequiresMaster(t *testing.T) {
+	if _, err := New(valkeyConfig("127.0.0.1:26379", "sentinel")); err == nil {
+		t.Error("expected an error without a master set name")
+	}
+}
+
+func valkeyConfig(address, mode string) config.Config {
+	return config.Config{
+		ValkeyAddresses: []string{address},
+		ValkeyMode:      mode,
+		CursorTTL:       time.Hour,
+	}
+}
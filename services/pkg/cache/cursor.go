@@ -3,7 +3,6 @@ package cache
 import (
 	"context"
 	"strconv"
-	"time"
 
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
 	"github.com/valkey-io/valkey-go"
@@ -12,11 +11,11 @@ import (
 const cursorKey = "cursor"
 
 // SaveCursor saves the Jetstream cursor to the cache, as the key 'cursor'.
-// The cursor expires after 2 minutes in the cache.
+// The cursor expires after the configured TTL, as the Jetstream only retains a limited window of events.
 func (v Valkey) SaveCursor(cursor int64) error {
 	value := strconv.FormatInt(cursor, 10)
 
-	cmd := v.client.B().Set().Key(cursorKey).Value(value).Ex(time.Second * 120).Build()
+	cmd := v.client.B().Set().Key(cursorKey).Value(value).Ex(v.cursorTTL).Build()
 	err := v.client.Do(context.Background(), cmd).Error()
 	if err != nil {
 		return util.WrapErr("failed to save cursor", err)
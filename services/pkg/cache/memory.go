@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+)
+
+// Memory is an in-process cache with the same expiry and lonely-age semantics as Valkey.
+// It's intended for local development and tests, as its contents are lost when the process exits.
+type Memory struct {
+	mu           sync.Mutex
+	posts        map[string]memoryPost
+	authors      map[string]map[string]struct{} // Hashes of each author's posts, keyed by DID
+	cursor       int64
+	cursorExpiry time.Time
+	cursorTTL    time.Duration
+	swept        time.Time // Time expired posts were last removed
+}
+
+type memoryPost struct {
+	record PostRecord
+	counts interactionCounts // Stored separately from the record, like in the other caches
+	expiry time.Time
+}
+
+// NewMemory creates an empty in-memory cache.
+func NewMemory(cfg config.Config) *Memory {
+	return &Memory{
+		posts:     make(map[string]memoryPost),
+		authors:   make(map[string]map[string]struct{}),
+		cursorTTL: cfg.CursorTTL,
+		swept:     time.Now(),
+	}
+}
+
+// SavePost saves a post record, expiring it relative to when the post was created.
+// Saving a post that's already cached keeps its interaction counts.
+func (m *Memory) SavePost(hash string, post PostRecord) error {
+	expiry := postExpiry(post)
+	if time.Until(expiry) <= 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sweep()
+
+	saved := memoryPost{record: post, expiry: expiry}
+	if existing, ok := m.posts[hash]; ok {
+		saved.counts = existing.counts
+	}
+	m.posts[hash] = saved
+
+	did := post.AuthorDID()
+	if m.authors[did] == nil {
+		m.authors[did] = make(map[string]struct{})
+	}
+	m.authors[did][hash] = struct{}{}
+
+	return nil
+}
+
+// Apply performs a batch of writes, in order.
+func (m *Memory) Apply(ops []Op) error {
+	for _, op := range ops {
+		switch op.Kind {
+		case OpSave:
+			m.SavePost(op.Hash, op.Post)
+		case OpDelete:
+			m.DeletePost(op.Hash)
+		case OpInteract:
+			m.Interact(op.Hash, op.Interaction, op.Timestamp)
+		}
+	}
+	return nil
+}
+
+// ReadPost reads a post record. If the record does not exist or has expired, return an empty record.
+func (m *Memory) ReadPost(hash string) (PostRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	post, ok := m.posts[hash]
+	if !ok || time.Now().After(post.expiry) {
+		return PostRecord{}, nil
+	}
+	return post.read(), nil
+}
+
+// ReadPosts returns up to 'n' posts, newest first, starting at the given cursor.
+// Only posts older than X minutes are included, to ensure a given post truly is "lonely".
+// The cursor is the timestamp of the last post returned, and the next page continues with older posts.
+// A cursor of zero starts from the newest lonely post, and is returned once there are no more posts.
+// Only posts that meet the criteria are returned.
+func (m *Memory) ReadPosts(n int, cursor uint64, criteria Criteria) ([]PostRecord, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	newest := criteria.Newest(now)
+	if cursor > 0 && cursor <= uint64(newest) {
+		newest = int64(cursor) - 1 // Exclusive, as the post at the cursor was on the previous page
+	}
+
+	eligible := make([]PostRecord, 0, len(m.posts))
+	for _, post := range m.posts {
+		record := post.read()
+		if now.After(post.expiry) || record.Timestamp > newest || !criteria.Match(record) {
+			continue
+		}
+		eligible = append(eligible, record)
+	}
+	slices.SortFunc(eligible, func(a, b PostRecord) int {
+		return cmp.Or(cmp.Compare(b.Timestamp, a.Timestamp), cmp.Compare(a.AtURI, b.AtURI))
+	})
+
+	if len(eligible) <= n {
+		return eligible, 0, nil
+	}
+	return eligible[:n], uint64(eligible[n-1].Timestamp), nil
+}
+
+// Interact counts an interaction with a post, if it's cached.
+func (m *Memory) Interact(hash string, kind InteractionKind, timestamp int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if post, ok := m.posts[hash]; ok {
+		post.counts = post.counts.add(kind, timestamp)
+		m.posts[hash] = post
+	}
+	return nil
+}
+
+// DeletePost deletes a post record.
+func (m *Memory) DeletePost(hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.posts, hash)
+	return nil
+}
+
+// DeleteAuthorPosts deletes every post by the given author, returning the number of posts deleted.
+func (m *Memory) DeleteAuthorPosts(did string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := 0
+	for hash := range m.authors[did] {
+		if _, ok := m.posts[hash]; ok {
+			delete(m.posts, hash)
+			deleted++
+		}
+	}
+	delete(m.authors, did)
+
+	return deleted, nil
+}
+
+// SaveCursor saves the Jetstream cursor, which expires after the configured TTL.
+func (m *Memory) SaveCursor(cursor int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cursor = cursor
+	m.cursorExpiry = time.Now().Add(m.cursorTTL)
+	return nil
+}
+
+// ReadCursor reads the Jetstream cursor, returning zero if none has been saved or it has expired.
+func (m *Memory) ReadCursor() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Now().After(m.cursorExpiry) {
+		return 0, nil
+	}
+	return m.cursor, nil
+}
+
+func (m *Memory) Close() {}
+
+// The post's record, with its interaction counts.
+func (p memoryPost) read() PostRecord {
+	return p.record.withCounts(p.counts)
+}
+
+// Remove expired posts, at most once a minute. Must be called with the lock held.
+func (m *Memory) sweep() {
+	now := time.Now()
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	m.swept = now
+
+	for hash, post := range m.posts {
+		if now.After(post.expiry) {
+			delete(m.posts, hash)
+		}
+	}
+	for did, hashes := range m.authors {
+		for hash := range hashes {
+			if _, ok := m.posts[hash]; !ok {
+				delete(hashes, hash)
+			}
+		}
+		if len(hashes) == 0 {
+			delete(m.authors, did)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+// The methods shared by every cache backend.
+type postCache interface {
+	SavePost(hash string, post PostRecord) error
+	ReadPost(hash string) (PostRecord, error)
+	ReadPosts(n int, cursor uint64, criteria Criteria) ([]PostRecord, uint64, error)
+	Interact(hash string, kind InteractionKind, timestamp int64) error
+	DeletePost(hash string) error
+	DeleteAuthorPosts(did string) (int, error)
+}
+
+func TestMemoryReadPosts(t *testing.T) {
+	testReadPosts(t, NewMemory(config.Config{}))
+}
+
+func TestMemoryReadPostsCriteria(t *testing.T) {
+	testReadPostsCriteria(t, NewMemory(config.Config{}))
+}
+
+func TestMemoryInteract(t *testing.T) {
+	testInteract(t, NewMemory(config.Config{}))
+}
+
+func TestMemoryDeleteAuthorPosts(t *testing.T) {
+	testDeleteAuthorPosts(t, NewMemory(config.Config{}))
+}
+
+func testReadPosts(t *testing.T, c postCache) {
+	// Save posts out of order, each a millisecond older than the last
+	lonely := time.Now().Add(-30 * time.Minute).UnixMicro()
+	for _, i := range rand.Perm(25) {
+		savePost(t, c, fmt.Sprintf("at://did:plc:lonely/app.bsky.feed.post/%d", i), lonely-int64(i)*1000)
+	}
+
+	// Posts that are too new to be lonely, or too old to still be cached, are never returned
+	savePost(t, c, "at://did:plc:new/app.bsky.feed.post/1", time.Now().UnixMicro())
+	savePost(t, c, "at://did:plc:expired/app.bsky.feed.post/1", time.Now().Add(-2*time.Hour).UnixMicro())
+
+	// Page through every post, expecting each lonely post exactly once, newest first
+	var uris []string
+	var cursor uint64
+	pages := 0
+	for {
+		posts, next, err := c.ReadPosts(10, cursor, Criteria{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(posts) > 10 {
+			t.Fatalf("expected at most 10 posts, got %d", len(posts))
+		}
+		for _, post := range posts {
+			uris = append(uris, post.AtURI)
+		}
+		pages++
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	if len(uris) != 25 {
+		t.Fatalf("expected 25 posts, got %d", len(uris))
+	}
+	for i, uri := range uris {
+		if expected := fmt.Sprintf("at://did:plc:lonely/app.bsky.feed.post/%d", i); uri != expected {
+			t.Errorf("expected %s at position %d, got %s", expected, i, uri)
+		}
+	}
+	if pages != 3 {
+		t.Errorf("expected 3 pages, got %d", pages)
+	}
+
+	// Deleted posts are removed from the results
+	c.DeletePost(util.Hash("at://did:plc:lonely/app.bsky.feed.post/0"))
+	posts, _, err := c.ReadPosts(1, 0, Criteria{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0].AtURI != "at://did:plc:lonely/app.bsky.feed.post/1" {
+		t.Errorf("expected deleted post to be skipped, got %+v", posts)
+	}
+}
+
+func testReadPostsCriteria(t *testing.T, c postCache) {
+	lonely := time.Now().Add(-20 * time.Minute).UnixMicro()
+	older := time.Now().Add(-40 * time.Minute).UnixMicro()
+	posts := []PostRecord{
+		{AtURI: "at://did:plc:a/app.bsky.feed.post/short", Timestamp: lonely, TextLength: 10, Languages: []string{"en"}, FilterScore: 1},
+		{AtURI: "at://did:plc:a/app.bsky.feed.post/long", Timestamp: lonely - 1, TextLength: 250, Languages: []string{"en"}, FilterScore: 1},
+		{AtURI: "at://did:plc:a/app.bsky.feed.post/older", Timestamp: older, TextLength: 10, Languages: []string{"en", "es"}, FilterScore: 0.5},
+	}
+	for _, post := range posts {
+		if err := c.SavePost(util.Hash(post.AtURI), post); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		criteria Criteria
+		expected []string
+	}{
+		{"none", Criteria{}, []string{"short", "long", "older"}},
+		{"min age", Criteria{MinAge: 30 * time.Minute}, []string{"older"}},
+		{"max text length", Criteria{MaxTextLength: 100}, []string{"short", "older"}},
+		{"languages", Criteria{Languages: []string{"es", "fr"}}, []string{"older"}},
+		{"min score", Criteria{MinScore: 0.8}, []string{"short", "long"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Read one post at a time, so that non-matching posts are skipped across pages
+			var rkeys []string
+			var cursor uint64
+			for {
+				page, next, err := c.ReadPosts(1, cursor, test.criteria)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, post := range page {
+					rkeys = append(rkeys, post.AtURI[strings.LastIndex(post.AtURI, "/")+1:])
+				}
+				if next == 0 {
+					break
+				}
+				cursor = next
+			}
+			if !slices.Equal(rkeys, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, rkeys)
+			}
+		})
+	}
+}
+
+func testInteract(t *testing.T, c postCache) {
+	uri := "at://did:plc:a/app.bsky.feed.post/1"
+	hash := util.Hash(uri)
+	lonely := time.Now().Add(-30 * time.Minute).UnixMicro()
+	savePost(t, c, uri, lonely)
+
+	// Interactions are counted by kind, keeping the earliest time even if they arrive out of order
+	for _, op := range []struct {
+		kind      InteractionKind
+		timestamp int64
+	}{{Like, lonely + 20}, {Like, lonely + 10}, {Reply, lonely + 30}} {
+		if err := c.Interact(hash, op.kind, op.timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	post, err := c.ReadPost(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Interactions{Likes: 2, Replies: 1}); post.Interactions != expected || post.FirstInteraction != lonely+10 {
+		t.Errorf("expected %+v first at %d, got %+v first at %d", expected, lonely+10, post.Interactions, post.FirstInteraction)
+	}
+
+	// The post is no longer lonely, but is included by criteria that allow its interactions
+	if posts, _, _ := c.ReadPosts(10, 0, Criteria{}); len(posts) != 0 {
+		t.Errorf("expected post with interactions to be excluded, got %+v", posts)
+	}
+	if posts, _, _ := c.ReadPosts(10, 0, Criteria{MaxInteractions: Interactions{Likes: 2, Replies: 1}}); len(posts) != 1 {
+		t.Errorf("expected post to be included, got %+v", posts)
+	}
+
+	// Saving the post again keeps its counts, but deleting it removes them
+	savePost(t, c, uri, lonely)
+	if post, _ := c.ReadPost(hash); post.Interactions.Likes != 2 {
+		t.Errorf("expected counts to be kept when saving again, got %+v", post.Interactions)
+	}
+	c.DeletePost(hash)
+	savePost(t, c, uri, lonely)
+	if post, _ := c.ReadPost(hash); post.Interactions != (Interactions{}) || post.FirstInteraction != 0 {
+		t.Errorf("expected counts to be deleted with the post, got %+v", post)
+	}
+
+	// Interactions with posts that aren't cached are ignored
+	missing := util.Hash("at://did:plc:a/app.bsky.feed.post/missing")
+	if err := c.Interact(missing, Like, lonely); err != nil {
+		t.Fatal(err)
+	}
+	if post, _ := c.ReadPost(missing); !post.IsEmpty() {
+		t.Errorf("expected interaction not to create a post, got %+v", post)
+	}
+}
+
+func testDeleteAuthorPosts(t *testing.T, c postCache) {
+	now := time.Now().UnixMicro()
+	savePost(t, c, "at://did:plc:a/app.bsky.feed.post/1", now)
+	savePost(t, c, "at://did:plc:a/app.bsky.feed.post/2", now)
+	savePost(t, c, "at://did:plc:b/app.bsky.feed.post/1", now)
+	c.DeletePost(util.Hash("at://did:plc:a/app.bsky.feed.post/2"))
+
+	deleted, err := c.DeleteAuthorPosts("did:plc:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 post deleted, got %d", deleted)
+	}
+	if post, _ := c.ReadPost(util.Hash("at://did:plc:b/app.bsky.feed.post/1")); post.IsEmpty() {
+		t.Error("expected other authors' posts to remain")
+	}
+}
+
+func TestMemoryCursor(t *testing.T) {
+	c := NewMemory(config.Config{CursorTTL: time.Hour})
+	if cursor, _ := c.ReadCursor(); cursor != 0 {
+		t.Errorf("expected no cursor, got %d", cursor)
+	}
+	c.SaveCursor(1000)
+	if cursor, _ := c.ReadCursor(); cursor != 1000 {
+		t.Errorf("expected cursor 1000, got %d", cursor)
+	}
+
+	// The cursor expires after its TTL
+	c.cursorExpiry = time.Now().Add(-time.Second)
+	if cursor, _ := c.ReadCursor(); cursor != 0 {
+		t.Errorf("expected expired cursor, got %d", cursor)
+	}
+}
+
+func savePost(t *testing.T, c postCache, atURI string, timestamp int64) {
+	t.Helper()
+
+	if err := c.SavePost(util.Hash(atURI), PostRecord{AtURI: atURI, Timestamp: timestamp}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"context"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/valkey-io/valkey-go"
+)
+
+const migrateScanCount = 1000
+
+// Migrate rewrites every post record stored in a previous version in the current version, returning the number rewritten.
+// Records keep their expiry, and those deleted by the intake while migrating aren't recreated.
+// On a cluster, each node's keys are scanned in turn.
+func (v Valkey) Migrate(ctx context.Context) (int, error) {
+	migrated := 0
+	for _, node := range v.client.Nodes() {
+		var cursor uint64
+		for {
+			cmd := node.B().Scan().Cursor(cursor).Match(v.postKey("*")).Count(migrateScanCount).Build()
+			entry, err := node.Do(ctx, cmd).AsScanEntry()
+			if err != nil {
+				return migrated, util.WrapErr("failed to scan post keys", err)
+			}
+
+			n, err := v.migrateKeys(ctx, entry.Elements)
+			migrated += n
+			if err != nil {
+				return migrated, err
+			}
+
+			cursor = entry.Cursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return migrated, nil
+}
+
+// Rewrite any of the given post records stored in a previous version.
+func (v Valkey) migrateKeys(ctx context.Context, keys []string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	resps, err := valkey.MGet(v.client, ctx, keys)
+	if err != nil {
+		return 0, util.WrapErr("failed to execute mget command", err)
+	}
+
+	cmds := make(valkey.Commands, 0, len(keys))
+	for _, key := range keys {
+		resp := resps[key]
+		if resp.IsNil() {
+			continue // Expired or deleted since the scan
+		}
+		bytes, err := resp.AsBytes()
+		if err != nil {
+			return 0, util.WrapErr("failed to convert response to bytes", err)
+		}
+
+		data, err := migrateRecord(bytes)
+		if err != nil {
+			return 0, util.WrapErr("failed to migrate record "+key, err)
+		}
+		if data != nil {
+			cmds = append(cmds, v.client.B().Set().Key(key).Value(string(data)).Xx().Keepttl().Build())
+		}
+	}
+	if len(cmds) == 0 {
+		return 0, nil
+	}
+
+	for _, resp := range v.client.DoMulti(ctx, cmds...) {
+		if err := resp.Error(); err != nil && !valkey.IsValkeyNil(err) {
+			return 0, util.WrapErr("failed to rewrite record", err)
+		}
+	}
+	return len(cmds), nil
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/vmihailenco/msgpack/v5"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The layout of post records before the version was stored.
+type legacyRecord struct {
+	AtURI     string
+	Timestamp int64 `msgpack:"t"`
+}
+
+func TestValkeyMigrate(t *testing.T) {
+	server := miniredis.RunT(t)
+	v := newValkeyClient(t, server.Addr())
+	uri := "at://did:plc:a/app.bsky.feed.post/1"
+	hash := util.Hash(uri)
+	timestamp := time.Now().Add(-30 * time.Minute).UnixMicro()
+
+	savePost(t, v, "at://did:plc:a/app.bsky.feed.post/2", timestamp)
+	legacy, err := msgpack.Marshal(legacyRecord{AtURI: uri, Timestamp: timestamp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Set(v.postKey(hash), string(legacy))
+	server.SetTTL(v.postKey(hash), time.Hour)
+
+	// Records in the previous version can be read before they're migrated
+	if post, err := v.ReadPost(hash); err != nil || post.AtURI != uri {
+		t.Fatalf("expected to read legacy record, got %+v (error %v)", post, err)
+	}
+
+	migrated, err := v.Migrate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Errorf("expected 1 record migrated, got %d", migrated)
+	}
+	data, _ := server.Get(v.postKey(hash))
+	if stored, _ := decodeStored([]byte(data)); stored.Version != recordVersion || stored.AtURI != uri {
+		t.Errorf("expected record in version %d, got %+v", recordVersion, stored)
+	}
+	if ttl := server.TTL(v.postKey(hash)); ttl != time.Hour {
+		t.Errorf("expected expiry to be kept, got %s", ttl)
+	}
+
+	// Records written by a newer version are skipped when read, but can't be migrated
+	newer, _ := msgpack.Marshal(storedRecord{Version: recordVersion + 1, PostRecord: PostRecord{AtURI: uri, Timestamp: timestamp}})
+	server.Set(v.postKey(hash), string(newer))
+	if post, err := v.ReadPost(hash); err != nil || !post.IsEmpty() {
+		t.Errorf("expected a newer record to be skipped, got %+v (error %v)", post, err)
+	}
+	if posts, _, err := v.ReadPosts(10, 0, Criteria{}); err != nil || len(posts) != 1 {
+		t.Errorf("expected only the current record to be read, got %+v (error %v)", posts, err)
+	}
+	if _, err := v.Migrate(context.Background()); err == nil {
+		t.Error("expected an error migrating a newer record")
+	}
+}
+
+func TestBoltMigrate(t *testing.T) {
+	b := openBolt(t, t.TempDir()+"/cache.db")
+	uri := "at://did:plc:a/app.bsky.feed.post/1"
+	timestamp := time.Now().UnixMicro()
+	savePost(t, b, uri, timestamp)
+
+	// Overwrite the saved record with the previous version's layout
+	legacy, err := msgpack.Marshal(legacyRecord{AtURI: uri, Timestamp: timestamp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(postsBucket).Put(postKey(timestamp, util.Hash(uri)), legacy)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []int{1, 0} {
+		migrated, err := b.Migrate(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if migrated != expected {
+			t.Errorf("expected %d records migrated, got %d", expected, migrated)
+		}
+	}
+	if post, _ := b.ReadPost(util.Hash(uri)); post.AtURI != uri {
+		t.Errorf("expected post %s, got %+v", uri, post)
+	}
+}
+
+func TestMigrateRecord(t *testing.T) {
+	uri := "at://did:plc:a/app.bsky.feed.post/1"
+	for version := range recordVersion {
+		data, _ := msgpack.Marshal(storedRecord{Version: version, PostRecord: PostRecord{AtURI: uri, Timestamp: 1}})
+		migrated, err := migrateRecord(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := decodeStored(migrated); stored.Version != recordVersion || stored.AtURI != uri {
+			t.Errorf("expected version %d record to be migrated, got %+v", version, stored)
+		}
+	}
+}
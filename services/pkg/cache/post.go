@@ -2,137 +2,337 @@ package cache
 
 import (
 	"context"
+	"crypto/sha1"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
 	"time"
 
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
 	"github.com/valkey-io/valkey-go"
-	"github.com/vmihailenco/msgpack/v5"
 )
 
-// SavePost saves a post record to the cache.
+// Maximum number of pages of the post index read by a single call to ReadPosts.
+const maxIndexReads = 10
+
+// Count an interaction with a post, if it's cached. The counts expire along with the post.
+// The earliest interaction time is kept, as a post's events may be processed out of order.
+const interactSource = `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[2], ARGV[1], 1)
+local first = redis.call('HGET', KEYS[2], 'first')
+if not first or tonumber(ARGV[2]) < tonumber(first) then
+	redis.call('HSET', KEYS[2], 'first', ARGV[2])
+end
+redis.call('PEXPIRE', KEYS[2], ttl)
+return 1
+`
+
+var (
+	interactScript = valkey.NewLuaScript(interactSource)
+	interactSHA    = fmt.Sprintf("%x", sha1.Sum([]byte(interactSource)))
+)
+
+// SavePost saves a post record to the cache, and adds it to the index of posts ordered by time.
+// The post is also added to an index of its author's posts, so that they can be purged if the account becomes inactive.
 func (v Valkey) SavePost(hash string, post PostRecord) error {
-	bytes, err := msgpack.Marshal(post)
-	if err != nil {
-		return util.WrapErr("failed to marshal record", err)
-	}
+	return v.Apply([]Op{SaveOp(hash, post)})
+}
 
-	key := fmt.Sprintf("post:%s", hash)
-	cmd := v.client.B().Set().Key(key).Value(string(bytes)).Ex(time.Second * TTLSeconds).Build()
-	err = v.client.Do(context.Background(), cmd).Error()
-	if err != nil {
-		return util.WrapErr("failed to set key", err)
+// Apply performs a batch of writes in a single pipeline, in order.
+func (v Valkey) Apply(ops []Op) error {
+	cmds := make(valkey.Commands, 0, len(ops)*5)
+	interactions := make(map[int]Op) // Interactions by their position in the pipeline
+	for _, op := range ops {
+		switch op.Kind {
+		case OpSave:
+			save, err := v.saveCmds(op.Hash, op.Post)
+			if err != nil {
+				return err
+			}
+			cmds = append(cmds, save...)
+		case OpDelete:
+			cmds = append(cmds, v.deleteCmds(op.Hash)...)
+		case OpInteract:
+			interactions[len(cmds)] = op
+			cmds = append(cmds, v.client.B().Evalsha().Sha1(interactSHA).Numkeys(2).Key(v.interactKeys(op.Hash)...).Arg(interactArgs(op)...).Build())
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
 	}
 
-	return nil
-}
+	for i, resp := range v.client.DoMulti(context.Background(), cmds...) {
+		err := resp.Error()
 
-// ReadPost reads a post record from the cache. If the record does not exist, return an empty record.
-func (v Valkey) ReadPost(hash string) (PostRecord, error) {
-	key := fmt.Sprintf("post:%s", hash)
-	cmd := v.client.B().Get().Key(key).Build()
-	resp := v.client.Do(context.Background(), cmd)
-	if err := resp.Error(); err != nil {
-		if err == valkey.Nil {
-			return PostRecord{}, nil
+		// Each server caches the script until it restarts. If it isn't cached, send it in full, which caches it again.
+		if verr, ok := valkey.IsValkeyErr(err); ok && verr.IsNoScript() {
+			op := interactions[i]
+			err = interactScript.Exec(context.Background(), v.client, v.interactKeys(op.Hash), interactArgs(op)).Error()
+		}
+		if err != nil {
+			return util.WrapErr("failed to apply batch", err)
 		}
-		return PostRecord{}, util.WrapErr("failed to execute get command", err)
 	}
+	return nil
+}
+
+// Interact counts an interaction with a post, if it's cached.
+// Counts are stored separately from the post record, so that they can be updated without rewriting it.
+func (v Valkey) Interact(hash string, kind InteractionKind, timestamp int64) error {
+	return v.Apply([]Op{InteractOp(hash, kind, timestamp)})
+}
+
+func (v Valkey) interactKeys(hash string) []string {
+	return []string{v.postKey(hash), v.interactionsKey(hash)}
+}
+
+func interactArgs(op Op) []string {
+	return []string{string(op.Interaction), strconv.FormatInt(op.Timestamp, 10)}
+}
 
-	bytes, err := resp.AsBytes()
+// Build the commands that save a post record.
+func (v Valkey) saveCmds(hash string, post PostRecord) (valkey.Commands, error) {
+	bytes, err := encodeRecord(post)
 	if err != nil {
-		return PostRecord{}, util.WrapErr("failed to convert response to bytes", err)
+		return nil, err
 	}
 
-	var record PostRecord
-	err = msgpack.Unmarshal(bytes, &record)
-	if err != nil {
-		return PostRecord{}, util.WrapErr("failed to unmarshal record", err)
+	// Posts expire relative to when they were created, rather than when they were saved.
+	// This ensures backfilled posts don't outlive those saved by the live intake.
+	expiry := postExpiry(post)
+	if time.Until(expiry) <= 0 {
+		return nil, nil
 	}
 
-	return record, nil
+	// The post is indexed by its timestamp. Entries for expired posts are trimmed from the index as new posts arrive.
+	// The author's index lives as long as their newest post, so saving an older post mustn't shorten it.
+	key := v.postKey(hash)
+	index := v.authorKey(post.AuthorDID())
+	expired := strconv.FormatInt(time.Now().Add(-time.Second*TTLSeconds).UnixMicro(), 10)
+	return valkey.Commands{
+		v.client.B().Set().Key(key).Value(string(bytes)).Exat(expiry).Build(),
+		v.client.B().Zadd().Key(v.indexKey()).ScoreMember().ScoreMember(float64(post.Timestamp), hash).Build(),
+		v.client.B().Zremrangebyscore().Key(v.indexKey()).Min("-inf").Max("(" + expired).Build(),
+		v.client.B().Sadd().Key(index).Member(hash).Build(),
+		v.client.B().Expireat().Key(index).Timestamp(expiry.Unix()).Nx().Build(),
+		v.client.B().Expireat().Key(index).Timestamp(expiry.Unix()).Gt().Build(),
+	}, nil
 }
 
-// ReadPosts scans the cache starting at the given cursor and returns 'n' posts.
-// Only posts older than X minutes are included, to ensure a given post truly is "lonely".
-func (v Valkey) ReadPosts(n int, cursor uint64) ([]PostRecord, uint64, error) {
-	result := make([]PostRecord, 0, n)
-	icursor := cursor // Internal cursor
-	threshold := time.Now().Add((-1 * LonelyMinutes) * time.Minute).UnixMicro()
-
-	// Prevent taxing the cache if there are not enough valid posts
-	scans := 0
-	maxScans := 30
+// ReadPost reads a post record from the cache, with its interaction counts. If the record does not exist, return an empty record.
+// Records are cached client-side until they change, or the cache TTL passes.
+func (v Valkey) ReadPost(hash string) (PostRecord, error) {
+	records, err := v.readRecords(v.reader(), []string{hash})
+	if err != nil || len(records) == 0 {
+		return PostRecord{}, err
+	}
+	return records[0], nil
+}
 
-	for len(result) < n && scans < maxScans {
-		scans++
+// ReadPosts returns up to 'n' posts, newest first, starting at the given cursor.
+// Only posts older than X minutes are included, to ensure a given post truly is "lonely".
+// The cursor is the timestamp of the last post returned, and the next page continues with older posts.
+// A cursor of zero starts from the newest lonely post, and is returned once there are no more posts.
+// Only posts that meet the criteria are returned. The index is read a page at a time until enough posts match, up to a
+// limit, after which a partial page is returned with a cursor to continue from.
+func (v Valkey) ReadPosts(n int, cursor uint64, criteria Criteria) ([]PostRecord, uint64, error) {
+	now := time.Now()
+	threshold := criteria.Newest(now)
+	newest := strconv.FormatInt(threshold, 10)
+	if cursor > 0 && cursor <= uint64(threshold) {
+		newest = fmt.Sprintf("(%d", cursor) // Exclusive, as the post at the cursor was on the previous page
+	}
+	oldest := strconv.FormatInt(now.Add(-time.Second*TTLSeconds).UnixMicro(), 10)
 
-		cmd := v.client.B().Scan().Cursor(icursor).Match("post:*").Count(10).Build()
-		resp := v.client.Do(context.Background(), cmd)
-		if err := resp.Error(); err != nil {
-			return nil, 0, util.WrapErr("failed to execute scan command", err)
+	// The index and records are read from the same node, so that they're consistent with each other
+	reader := v.reader()
+	result := make([]PostRecord, 0, n)
+	for range maxIndexReads {
+		cmd := reader.B().Zrange().Key(v.indexKey()).Min(newest).Max(oldest).Byscore().Rev().Limit(0, int64(n)).Withscores().Build()
+		entries, err := reader.Do(context.Background(), cmd).AsZScores()
+		if err != nil {
+			return nil, 0, util.WrapErr("failed to read post index", err)
 		}
 
-		res, err := resp.ToArray()
+		hashes := make([]string, len(entries))
+		for i, entry := range entries {
+			hashes[i] = entry.Member
+		}
+		records, err := v.readRecords(reader, hashes)
 		if err != nil {
-			return nil, 0, util.WrapErr("failed to convert response to array", err)
+			return nil, 0, err
 		}
-		if len(res) < 2 {
-			return nil, 0, util.WrapErr("invalid scan response format", nil)
+		for _, record := range records {
+			if criteria.Match(record) {
+				result = append(result, record)
+			}
 		}
 
-		icursor, err = res[0].AsUint64()
-		if err != nil {
-			return nil, 0, util.WrapErr("failed to parse cursor", err)
+		if len(result) >= n {
+			return result[:n], uint64(result[n-1].Timestamp), nil
 		}
-
-		keys, err := res[1].AsStrSlice()
-		if err != nil {
-			return nil, 0, util.WrapErr("failed to parse keys", err)
+		// A partial page means there are no older posts
+		if len(entries) < n {
+			return result, 0, nil
 		}
 
-		for _, key := range keys {
-			hash := key[5:]
-			record, err := v.ReadPost(hash)
-			if err != nil {
-				return nil, 0, util.WrapErr(fmt.Sprintf("failed to read post with hash %s", hash), err)
-			}
+		// Not enough posts met the criteria, so continue with older posts
+		cursor = uint64(entries[len(entries)-1].Score)
+		newest = fmt.Sprintf("(%d", cursor)
+	}
 
-			if record.IsEmpty() {
-				slog.Debug("ignoring empty post", "at_uri", record.AtURI)
-				continue
-			}
+	return result, cursor, nil
+}
 
-			// Ignore posts that are less than X minutes old
-			if record.Timestamp > threshold {
-				slog.Debug("ignoring new post", "at_uri", record.AtURI, "timestamp", record.Timestamp)
-				continue
-			}
+// Read post records and their interaction counts, skipping any that have expired or been deleted.
+func (v Valkey) readRecords(reader valkey.Client, hashes []string) ([]PostRecord, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
 
-			slog.Debug("found post", "at_uri", record.AtURI, "timestamp", record.Timestamp)
+	// Read every record and its counts from the client-side cache, fetching any that aren't cached in a single round trip.
+	// The index itself changes with every new post, so it isn't worth caching.
+	cmds := make([]valkey.CacheableTTL, 0, len(hashes)*2)
+	for _, hash := range hashes {
+		cmds = append(cmds,
+			valkey.CT(reader.B().Get().Key(v.postKey(hash)).Cache(), v.cacheTTL),
+			valkey.CT(reader.B().Hgetall().Key(v.interactionsKey(hash)).Cache(), v.cacheTTL),
+		)
+	}
+	resps := reader.DoMultiCache(context.Background(), cmds...)
 
-			result = append(result, record)
-			if len(result) >= n {
-				break
-			}
+	result := make([]PostRecord, 0, len(hashes))
+	hits := 0
+	for i, hash := range hashes {
+		resp, counts := resps[i*2], resps[i*2+1]
+		if resp.IsCacheHit() {
+			hits++
+		}
+
+		bytes, err := resp.AsBytes()
+		if err != nil && !valkey.IsValkeyNil(err) {
+			return nil, util.WrapErr("failed to convert response to bytes", err)
+		}
+		record, err := decodeRecord(bytes)
+		if errors.Is(err, errNewerRecord) {
+			slog.Warn("skipping post written by a newer version", "hash", hash, "error", err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, util.WrapErr(fmt.Sprintf("failed to read post with hash %s", hash), err)
+		}
+
+		// The record may have expired or been deleted since the index was read
+		if record.IsEmpty() {
+			slog.Debug("ignoring empty post", "hash", hash)
+			continue
 		}
 
-		if icursor == 0 {
-			scans = maxScans // Stop scanning if we reach the end
+		fields, err := counts.AsIntMap()
+		if err != nil {
+			return nil, util.WrapErr(fmt.Sprintf("failed to read interactions with post with hash %s", hash), err)
 		}
+		record = record.withCounts(interactionCounts{
+			Interactions: Interactions{
+				Likes:   int(fields[string(Like)]),
+				Reposts: int(fields[string(Repost)]),
+				Quotes:  int(fields[string(Quote)]),
+				Replies: int(fields[string(Reply)]),
+			},
+			First: fields["first"],
+		})
+
+		slog.Debug("found post", "at_uri", record.AtURI, "timestamp", record.Timestamp)
+		result = append(result, record)
 	}
 
-	return result, icursor, nil
+	slog.Debug("read posts", "posts", len(result), "cache_hits", hits)
+	return result, nil
 }
 
-// DeletePost deletes a post record from the cache.
+// DeletePost deletes a post record from the cache, and removes it from the index.
 func (v Valkey) DeletePost(hash string) error {
-	key := fmt.Sprintf("post:%s", hash)
-	cmd := v.client.B().Del().Key(key).Build()
-	err := v.client.Do(context.Background(), cmd).Error()
+	return v.Apply([]Op{DeleteOp(hash)})
+}
+
+// Build the commands that delete a post record.
+func (v Valkey) deleteCmds(hash string) valkey.Commands {
+	return valkey.Commands{
+		v.client.B().Del().Key(v.postKey(hash)).Build(),
+		v.client.B().Del().Key(v.interactionsKey(hash)).Build(),
+		v.client.B().Zrem().Key(v.indexKey()).Member(hash).Build(),
+	}
+}
+
+// DeleteAuthorPosts deletes every cached post by the given author, returning the number of posts deleted.
+// The author index may reference posts that have since been deleted, which are skipped.
+func (v Valkey) DeleteAuthorPosts(did string) (int, error) {
+	index := v.authorKey(did)
+	cmd := v.client.B().Smembers().Key(index).Build()
+	hashes, err := v.client.Do(context.Background(), cmd).AsStrSlice()
 	if err != nil {
-		return util.WrapErr("failed to delete key", err)
+		return 0, util.WrapErr("failed to read author index", err)
 	}
-	return nil
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+
+	// Each post may be stored on a different cluster node, so they're deleted individually in a single round trip
+	cmds := make(valkey.Commands, 0, len(hashes)*2+2)
+	for _, hash := range hashes {
+		cmds = append(cmds, v.client.B().Del().Key(v.postKey(hash)).Build())
+	}
+	cmds = append(cmds,
+		v.client.B().Del().Key(index).Build(),
+		v.client.B().Zrem().Key(v.indexKey()).Member(hashes...).Build(),
+	)
+	for _, hash := range hashes {
+		cmds = append(cmds, v.client.B().Del().Key(v.interactionsKey(hash)).Build())
+	}
+	resps := v.client.DoMulti(context.Background(), cmds...)
+
+	deleted := int64(0)
+	for _, resp := range resps[:len(hashes)] {
+		n, err := resp.AsInt64()
+		if err != nil {
+			return 0, util.WrapErr("failed to delete keys", err)
+		}
+		deleted += n
+	}
+	if err := resps[len(hashes)].Error(); err != nil {
+		return 0, util.WrapErr("failed to delete author index", err)
+	}
+	if err := resps[len(hashes)+1].Error(); err != nil {
+		return 0, util.WrapErr("failed to remove posts from index", err)
+	}
+	for _, resp := range resps[len(hashes)+2:] {
+		if err := resp.Error(); err != nil {
+			return 0, util.WrapErr("failed to delete interactions", err)
+		}
+	}
+
+	return int(deleted), nil
+}
+
+// Sorted set of post hashes, scored by timestamp.
+func (v Valkey) indexKey() string {
+	return v.prefix + "index:posts"
+}
+
+func (v Valkey) postKey(hash string) string {
+	return fmt.Sprintf("%spost:%s", v.prefix, hash)
+}
+
+// Interaction counts for a post. The post's key is the hash tag, so on a cluster they're stored on the same node as the post.
+func (v Valkey) interactionsKey(hash string) string {
+	return "{" + v.postKey(hash) + "}:interactions"
+}
+
+func (v Valkey) authorKey(did string) string {
+	return fmt.Sprintf("%sauthor:%s", v.prefix, util.Hash(did))
 }
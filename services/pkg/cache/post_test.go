@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/valkey-io/valkey-go"
+)
+
+func TestValkeyReadPosts(t *testing.T) {
+	testReadPosts(t, newTestValkey(t))
+}
+
+func TestValkeyReadPostsCriteria(t *testing.T) {
+	testReadPostsCriteria(t, newTestValkey(t))
+}
+
+func TestValkeyReadPostsMissingRecord(t *testing.T) {
+	v := newTestValkey(t)
+	lonely := time.Now().Add(-30 * time.Minute).UnixMicro()
+	savePost(t, v, "at://did:plc:a/app.bsky.feed.post/1", lonely)
+	savePost(t, v, "at://did:plc:a/app.bsky.feed.post/2", lonely-1)
+
+	// A record can expire before its index entry is trimmed
+	cmd := v.client.B().Del().Key(v.postKey(util.Hash("at://did:plc:a/app.bsky.feed.post/1"))).Build()
+	if err := v.client.Do(context.Background(), cmd).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	posts, _, err := v.ReadPosts(10, 0, Criteria{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0].AtURI != "at://did:plc:a/app.bsky.feed.post/2" {
+		t.Errorf("expected missing record to be skipped, got %+v", posts)
+	}
+}
+
+func TestValkeyInteract(t *testing.T) {
+	server := miniredis.RunT(t)
+	v := newValkeyClient(t, server.Addr())
+	testInteract(t, v)
+
+	// Counts expire along with their post
+	hash := util.Hash("at://did:plc:a/app.bsky.feed.post/1")
+	v.Interact(hash, Like, time.Now().UnixMicro())
+	if post, counts := server.TTL(v.postKey(hash)), server.TTL(v.interactionsKey(hash)); post-counts > time.Millisecond || counts == 0 {
+		t.Errorf("expected counts to expire with the post in %s, got %s", post, counts)
+	}
+}
+
+func TestValkeyAuthorIndexExpiry(t *testing.T) {
+	server := miniredis.RunT(t)
+	v := newValkeyClient(t, server.Addr())
+
+	now := time.Now()
+	savePost(t, v, "at://did:plc:a/app.bsky.feed.post/1", now.UnixMicro())
+	savePost(t, v, "at://did:plc:a/app.bsky.feed.post/2", now.Add(-time.Hour).UnixMicro())
+
+	// Saving an older post must not shorten the index's lifetime
+	if ttl := server.TTL(v.authorKey("did:plc:a")); ttl < time.Second*TTLSeconds-time.Minute {
+		t.Errorf("expected the author index to expire with the newest post, got %s", ttl)
+	}
+}
+
+func TestValkeyDeleteAuthorPosts(t *testing.T) {
+	testDeleteAuthorPosts(t, newTestValkey(t))
+}
+
+// Measures the latency of reading a page of the feed.
+// Runs against the Valkey at BENCHMARK_VALKEY_ADDRESS if set, otherwise against an in-process stand-in.
+// Posts written by the benchmark are kept apart from the feed's posts, and deleted once it finishes.
+func BenchmarkValkeyReadPosts(b *testing.B) {
+	address := os.Getenv("BENCHMARK_VALKEY_ADDRESS")
+	if address == "" {
+		address = miniredis.RunT(b).Addr()
+	}
+	v := newValkeyClient(b, address)
+	v.prefix = "benchmark:"
+	b.Cleanup(func() {
+		for _, pattern := range []string{v.prefix + "*", "{" + v.prefix + "*"} {
+			err := v.scan(pattern, func(keys []string) error {
+				return v.client.Do(context.Background(), v.client.B().Del().Key(keys...).Build()).Error()
+			})
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+
+	lonely := time.Now().Add(-30 * time.Minute).UnixMicro()
+	for i := range 5000 {
+		uri := fmt.Sprintf("at://did:plc:benchmark/app.bsky.feed.post/%d", i)
+		if err := v.SavePost(util.Hash(uri), PostRecord{AtURI: uri, Timestamp: lonely - int64(i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for b.Loop() {
+		if _, _, err := v.ReadPosts(30, 0, Criteria{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Create a client connected to an in-process stand-in for Valkey.
+func newTestValkey(t *testing.T) Valkey {
+	t.Helper()
+	return newValkeyClient(t, miniredis.RunT(t).Addr())
+}
+
+func newValkeyClient(t testing.TB, address string) Valkey {
+	t.Helper()
+
+	// The stand-in doesn't support client-side caching, and would otherwise be mistaken for a cluster
+	client, err := valkey.NewClient(valkey.ClientOption{
+		InitAddress:       []string{address},
+		DisableCache:      true,
+		ForceSingleClient: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return Valkey{client: client, cursorTTL: time.Hour}
+}
@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/valkey-io/valkey-go"
+)
+
+const replicaCheckInterval = 5 * time.Second
+
+var errReplicaLinkDown = errors.New("replica is not connected to its primary")
+
+// Read replicas that posts can be read from, instead of the primary.
+// Each replica's replication status is checked periodically, and only replicas that are connected to the primary
+// and have heard from it recently are used.
+type replicas struct {
+	clients []valkey.Client
+	healthy []atomic.Bool
+	next    atomic.Uint64 // Reads are spread across healthy replicas in turn
+	maxLag  time.Duration
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Connect to each replica address with the same options as the primary, and start checking their health.
+func newReplicas(addresses []string, option valkey.ClientOption, maxLag time.Duration) (*replicas, error) {
+	r := &replicas{
+		healthy: make([]atomic.Bool, len(addresses)),
+		maxLag:  maxLag,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	option.Sentinel = valkey.SentinelOption{}
+	option.ForceSingleClient = true
+	for _, address := range addresses {
+		option.InitAddress = []string{address}
+		client, err := valkey.NewClient(option)
+		if err != nil {
+			for _, c := range r.clients {
+				c.Close()
+			}
+			return nil, util.WrapErr(fmt.Sprintf("failed to create client for replica %s", address), err)
+		}
+		r.clients = append(r.clients, client)
+	}
+
+	r.check()
+	go r.monitor()
+	return r, nil
+}
+
+// Return the next healthy replica, or false if none are healthy.
+func (r *replicas) client() (valkey.Client, bool) {
+	start := r.next.Add(1)
+	for i := range r.clients {
+		index := (start + uint64(i)) % uint64(len(r.clients))
+		if r.healthy[index].Load() {
+			return r.clients[index], true
+		}
+	}
+	return nil, false
+}
+
+// Check the replication status of every replica, logging any that become healthy or unhealthy.
+func (r *replicas) check() {
+	for i, client := range r.clients {
+		err := r.status(client)
+		healthy := err == nil
+		if r.healthy[i].Swap(healthy) == healthy {
+			continue
+		}
+
+		if healthy {
+			slog.Info("replica is healthy, reading from it", "replica", i)
+		} else {
+			slog.Warn("replica is unhealthy, reading from the primary instead", "replica", i, "error", err.Error())
+		}
+	}
+}
+
+// Return an error if the replica is disconnected from its primary, or lagging behind it.
+func (r *replicas) status(client valkey.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaCheckInterval)
+	defer cancel()
+
+	cmd := client.B().Info().Section("replication").Build()
+	info, err := client.Do(ctx, cmd).ToString()
+	if err != nil {
+		return util.WrapErr("failed to read replication status", err)
+	}
+
+	lag, err := replicaLag(info)
+	if err != nil {
+		return err
+	}
+	if lag > r.maxLag {
+		return fmt.Errorf("replica last heard from its primary %s ago", lag)
+	}
+	return nil
+}
+
+// Periodically check the health of each replica until closed.
+func (r *replicas) monitor() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.check()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *replicas) close() {
+	close(r.stop)
+	<-r.stopped
+	for _, client := range r.clients {
+		client.Close()
+	}
+}
+
+// Parse the time since a replica last heard from its primary, from the output of 'INFO replication'.
+func replicaLag(info string) (time.Duration, error) {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if ok {
+			fields[key] = value
+		}
+	}
+
+	if fields["role"] != "slave" {
+		return 0, fmt.Errorf("node has role %s, not a replica", fields["role"])
+	}
+	if fields["master_link_status"] != "up" {
+		return 0, errReplicaLinkDown
+	}
+
+	seconds, err := strconv.Atoi(fields["master_last_io_seconds_ago"])
+	if err != nil {
+		return 0, util.WrapErr("failed to parse time since last contact with primary", err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
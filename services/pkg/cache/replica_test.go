@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestReplicaLag(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		lag  time.Duration
+		ok   bool
+	}{
+		{"connected", "# Replication\r\nrole:slave\r\nmaster_link_status:up\r\nmaster_last_io_seconds_ago:3\r\n", 3 * time.Second, true},
+		{"disconnected", "# Replication\r\nrole:slave\r\nmaster_link_status:down\r\nmaster_last_io_seconds_ago:-1\r\n", 0, false},
+		{"primary", "# Replication\r\nrole:master\r\nconnected_slaves:1\r\n", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lag, err := replicaLag(test.info)
+			if (err == nil) != test.ok {
+				t.Fatalf("expected ok %t, got error %v", test.ok, err)
+			}
+			if lag != test.lag {
+				t.Errorf("expected lag %s, got %s", test.lag, lag)
+			}
+		})
+	}
+}
+
+func TestValkeyReadReplicaFallback(t *testing.T) {
+	// The stand-in can't report its replication status, so the replica starts out unhealthy
+	cfg := valkeyConfig(miniredis.RunT(t).Addr(), "single")
+	cfg.ValkeyReadAddresses = []string{miniredis.RunT(t).Addr()}
+	cfg.ValkeyReplicaMaxLag = 10 * time.Second
+	v, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	savePost(t, v, "at://did:plc:a/app.bsky.feed.post/1", time.Now().Add(-30*time.Minute).UnixMicro())
+	if posts, _, err := v.ReadPosts(10, 0, Criteria{}); err != nil || len(posts) != 1 {
+		t.Fatalf("expected to read the post from the primary, got %d posts (error %v)", len(posts), err)
+	}
+
+	// Once healthy, reads go to the replica, which doesn't replicate the primary in this test
+	v.replicas.healthy[0].Store(true)
+	if posts, _, err := v.ReadPosts(10, 0, Criteria{}); err != nil || len(posts) != 0 {
+		t.Fatalf("expected to read from the replica, got %d posts (error %v)", len(posts), err)
+	}
+}
@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/config"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/valkey-io/valkey-go"
+)
+
+const (
+	stagingPrefix = "staging:"
+
+	// Maximum number of keys read or written in a single round trip while clearing or promoting staged posts.
+	// Work is split into batches so that other clients, such as the live intake, aren't blocked while it runs.
+	stagingBatchSize = 1000
+)
+
+var (
+	errNotStaging     = errors.New("cache is not a staging namespace")
+	errStagingCluster = errors.New("staging is not supported in cluster mode")
+)
+
+// Move a staged post into the live namespace, and add it to the live index.
+// Its staged interaction counts are merged into any live counts, as the live intake may have counted interactions
+// since the backfill ended. Both may have counted the same interactions, so the larger of each count is kept,
+// along with the earliest interaction time. The counts expire along with the post.
+var promotePostScript = valkey.NewLuaScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('RENAME', KEYS[1], KEYS[2])
+redis.call('ZADD', KEYS[5], ARGV[1], ARGV[2])
+
+local counts = redis.call('HGETALL', KEYS[3])
+if #counts == 0 then
+	return 1
+end
+for i = 1, #counts, 2 do
+	local field, value = counts[i], counts[i + 1]
+	local current = redis.call('HGET', KEYS[4], field)
+	if not current then
+		redis.call('HSET', KEYS[4], field, value)
+	elseif field == 'first' and tonumber(value) < tonumber(current) then
+		redis.call('HSET', KEYS[4], field, value)
+	elseif field ~= 'first' and tonumber(value) > tonumber(current) then
+		redis.call('HSET', KEYS[4], field, value)
+	end
+end
+redis.call('PEXPIRE', KEYS[4], redis.call('PTTL', KEYS[2]))
+redis.call('DEL', KEYS[3])
+return 1
+`)
+
+// Merge a staged author index into the live one, keeping whichever expires later.
+var promoteAuthorScript = valkey.NewLuaScript(`
+local staged = redis.call('PTTL', KEYS[1])
+if staged < 0 then
+	return 0
+end
+local ttl = math.max(staged, redis.call('PTTL', KEYS[2]))
+redis.call('SUNIONSTORE', KEYS[2], KEYS[1], KEYS[2])
+redis.call('PEXPIRE', KEYS[2], ttl)
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// NewStaging creates a Valkey client that reads and writes posts in a staging namespace, separate from the live feed.
+// Once the staged posts are complete, Promote merges them into the live feed.
+// Promotion moves keys between namespaces, which may hash to different cluster slots, so it can't run on a cluster.
+func NewStaging(cfg config.Config) (Valkey, error) {
+	v, err := New(cfg)
+	if err != nil {
+		return Valkey{}, err
+	}
+	if v.client.Mode() == valkey.ClientModeCluster {
+		v.Close()
+		return Valkey{}, errStagingCluster
+	}
+	v.prefix = stagingPrefix
+	return v, nil
+}
+
+// Clear deletes every staged post, interaction count, author index and post index,
+// such as those left behind by an incomplete backfill.
+// Interaction counts are named after their post's key, within braces, so the prefix follows the opening brace.
+func (v Valkey) Clear() error {
+	if v.prefix == "" {
+		return errNotStaging
+	}
+
+	for _, pattern := range []string{v.prefix + "post:*", "{" + v.prefix + "post:*", v.prefix + "author:*", v.prefix + "index:*"} {
+		err := v.scan(pattern, func(keys []string) error {
+			return v.client.Do(context.Background(), v.client.B().Del().Key(keys...).Build()).Error()
+		})
+		if err != nil {
+			return util.WrapErr("failed to clear staged posts", err)
+		}
+	}
+	return nil
+}
+
+// Promote merges the staged posts into the live posts, returning the number of posts promoted.
+// The staged posts replace every live post between the start and end times, given in microseconds, so any live post in
+// that range that wasn't staged is deleted. Live posts outside the range are kept, as the backfill didn't see them.
+// Renaming preserves each key's expiry. The cursor is left untouched, as it belongs to the live intake.
+func (v Valkey) Promote(start, end int64) (int, error) {
+	if v.prefix == "" {
+		return 0, errNotStaging
+	}
+	live := v
+	live.prefix = ""
+
+	promoted, err := v.promotePosts(live)
+	if err != nil {
+		return 0, util.WrapErr("failed to promote staged posts", err)
+	}
+	if err := v.promoteAuthors(live); err != nil {
+		return 0, util.WrapErr("failed to promote staged author indexes", err)
+	}
+	if err := v.replaceLivePosts(live, start, end); err != nil {
+		return 0, util.WrapErr("failed to delete replaced live posts", err)
+	}
+
+	// Discard the staged index, and any counts for posts that expired before they could be promoted
+	if err := v.Clear(); err != nil {
+		return 0, err
+	}
+	return promoted, nil
+}
+
+// Move each post in the staged index into the live namespace.
+func (v Valkey) promotePosts(live Valkey) (int, error) {
+	promoted := 0
+	err := v.scanIndex(v.indexKey(), func(hashes []string, scores []string) error {
+		execs := make([]valkey.LuaExec, len(hashes))
+		for i, hash := range hashes {
+			execs[i] = valkey.LuaExec{
+				Keys: []string{v.postKey(hash), live.postKey(hash), v.interactionsKey(hash), live.interactionsKey(hash), live.indexKey()},
+				Args: []string{scores[i], hash},
+			}
+		}
+		for _, resp := range promotePostScript.ExecMulti(context.Background(), v.client, execs...) {
+			n, err := resp.AsInt64()
+			if err != nil {
+				return err
+			}
+			promoted += int(n)
+		}
+		return nil
+	})
+	return promoted, err
+}
+
+// Merge each staged author index into the live one.
+func (v Valkey) promoteAuthors(live Valkey) error {
+	return v.scan(v.prefix+"author:*", func(keys []string) error {
+		execs := make([]valkey.LuaExec, len(keys))
+		for i, key := range keys {
+			execs[i] = valkey.LuaExec{Keys: []string{key, key[len(v.prefix):]}}
+		}
+		for _, resp := range promoteAuthorScript.ExecMulti(context.Background(), v.client, execs...) {
+			if err := resp.Error(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete live posts between the start and end times that aren't in the staged index,
+// such as those deleted while the intake was down.
+func (v Valkey) replaceLivePosts(live Valkey, start, end int64) error {
+	return v.scanIndex(live.indexKey(), func(hashes []string, scores []string) error {
+		var candidates []string
+		for i, hash := range hashes {
+			if score, err := strconv.ParseFloat(scores[i], 64); err == nil && score >= float64(start) && score <= float64(end) {
+				candidates = append(candidates, hash)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+
+		cmd := v.client.B().Zmscore().Key(v.indexKey()).Member(candidates...).Build()
+		staged, err := v.client.Do(context.Background(), cmd).ToArray()
+		if err != nil {
+			return err
+		}
+		var cmds valkey.Commands
+		for i, hash := range candidates {
+			if staged[i].IsNil() {
+				cmds = append(cmds, live.deleteCmds(hash)...)
+			}
+		}
+		for _, resp := range v.client.DoMulti(context.Background(), cmds...) {
+			if err := resp.Error(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Call fn with each batch of keys matching the pattern.
+func (v Valkey) scan(pattern string, fn func(keys []string) error) error {
+	cursor := uint64(0)
+	for {
+		cmd := v.client.B().Scan().Cursor(cursor).Match(pattern).Count(stagingBatchSize).Build()
+		entry, err := v.client.Do(context.Background(), cmd).AsScanEntry()
+		if err != nil {
+			return err
+		}
+		if len(entry.Elements) > 0 {
+			if err := fn(entry.Elements); err != nil {
+				return err
+			}
+		}
+		if entry.Cursor == 0 {
+			return nil
+		}
+		cursor = entry.Cursor
+	}
+}
+
+// Call fn with each batch of members of a sorted set, along with their scores.
+func (v Valkey) scanIndex(key string, fn func(members []string, scores []string) error) error {
+	cursor := uint64(0)
+	for {
+		cmd := v.client.B().Zscan().Key(key).Cursor(cursor).Count(stagingBatchSize).Build()
+		entry, err := v.client.Do(context.Background(), cmd).AsScanEntry()
+		if err != nil {
+			return err
+		}
+		members := make([]string, 0, len(entry.Elements)/2)
+		scores := make([]string, 0, len(entry.Elements)/2)
+		for i := 0; i+1 < len(entry.Elements); i += 2 {
+			members = append(members, entry.Elements[i])
+			scores = append(scores, entry.Elements[i+1])
+		}
+		if len(members) > 0 {
+			if err := fn(members, scores); err != nil {
+				return err
+			}
+		}
+		if entry.Cursor == 0 {
+			return nil
+		}
+		cursor = entry.Cursor
+	}
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+)
+
+func TestValkeyPromote(t *testing.T) {
+	server := miniredis.RunT(t)
+	cfg := valkeyConfig(server.Addr(), "single")
+	live, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	staging, err := NewStaging(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staging.Close()
+
+	// The backfill covers half an hour up to ten minutes ago. The live intake has been running since before then.
+	end := time.Now().Add(-10 * time.Minute)
+	start := end.Add(-30 * time.Minute)
+	lonely := end.Add(-20 * time.Minute).UnixMicro()
+	older := "at://did:plc:c/app.bsky.feed.post/older"
+	savePost(t, live, older, start.Add(-20*time.Minute).UnixMicro())
+	deleted := "at://did:plc:a/app.bsky.feed.post/deleted"
+	savePost(t, live, deleted, lonely)
+	recent := "at://did:plc:a/app.bsky.feed.post/recent"
+	savePost(t, live, recent, end.Add(time.Minute).UnixMicro())
+	shared := "at://did:plc:b/app.bsky.feed.post/shared"
+	savePost(t, live, shared, lonely)
+	live.Interact(util.Hash(shared), Like, end.Add(time.Minute).UnixMicro())
+	live.Interact(util.Hash(shared), Like, end.Add(2*time.Minute).UnixMicro())
+
+	staged := "at://did:plc:a/app.bsky.feed.post/staged"
+	savePost(t, staging, staged, lonely)
+	staging.Interact(util.Hash(staged), Like, lonely+1)
+	savePost(t, staging, shared, lonely)
+	staging.Interact(util.Hash(shared), Reply, lonely+1)
+
+	promoted, err := staging.Promote(start.UnixMicro(), end.UnixMicro())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted != 2 {
+		t.Errorf("expected 2 posts promoted, got %d", promoted)
+	}
+
+	// Live posts within the backfill are replaced by the staged posts, while earlier and later posts are kept
+	if post, _ := live.ReadPost(util.Hash(deleted)); !post.IsEmpty() {
+		t.Errorf("expected live post within the backfill to be replaced, got %+v", post)
+	}
+	if post, _ := live.ReadPost(util.Hash(older)); post.AtURI != older {
+		t.Errorf("expected live post before the start time to be kept, got %+v", post)
+	}
+	if post, _ := live.ReadPost(util.Hash(recent)); post.AtURI != recent {
+		t.Errorf("expected live post after the end time to be kept, got %+v", post)
+	}
+	post, err := live.ReadPost(util.Hash(staged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.AtURI != staged || post.Interactions.Likes != 1 {
+		t.Errorf("expected staged post with 1 like, got %+v", post)
+	}
+
+	// Counts are merged with those the live intake made since the end time
+	post, err = live.ReadPost(util.Hash(shared))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.Interactions.Likes != 2 || post.Interactions.Replies != 1 || post.FirstInteraction != lonely+1 {
+		t.Errorf("expected merged counts, got %+v", post)
+	}
+
+	// Author indexes are merged, so purging an author covers both live and staged posts
+	if purged, err := live.DeleteAuthorPosts("did:plc:a"); err != nil || purged != 2 {
+		t.Errorf("expected to purge 2 posts, got %d (%v)", purged, err)
+	}
+	for _, key := range server.Keys() {
+		if strings.Contains(key, stagingPrefix) {
+			t.Errorf("expected staging to be empty, got %s", key)
+		}
+	}
+}
+
+func TestValkeyClear(t *testing.T) {
+	server := miniredis.RunT(t)
+	staging, err := NewStaging(valkeyConfig(server.Addr(), "single"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staging.Close()
+
+	lonely := time.Now().Add(-30 * time.Minute).UnixMicro()
+	for i := range 10 {
+		uri := fmt.Sprintf("at://did:plc:a/app.bsky.feed.post/%d", i)
+		savePost(t, staging, uri, lonely)
+		staging.Interact(util.Hash(uri), Like, lonely)
+	}
+	live, err := New(valkeyConfig(server.Addr(), "single"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	savePost(t, live, "at://did:plc:a/app.bsky.feed.post/live", lonely)
+
+	if err := staging.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the live post and its indexes remain
+	if keys := server.Keys(); len(keys) != 3 {
+		t.Errorf("expected staging to be empty, got %v", keys)
+	}
+}
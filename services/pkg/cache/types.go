@@ -1,10 +1,237 @@
 package cache
 
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Version of the stored post record layout.
+// Adding a field doesn't need a new version, as decoders ignore fields they don't recognize, and older records decode
+// the new field as its zero value. Renaming, removing or changing the meaning of a field does: bump the version, and
+// convert records in the previous layout in decodeRecord. Readers skip records in newer versions, so that the intake and
+// server can be deployed independently, but deploy readers first, as the skipped posts are missing from the feed until then.
+//
+// Version 2 records may have been interacted with, as interactions are counted rather than deleting the post.
+// Readers of earlier versions would serve them as lonely, so they skip them instead.
+const recordVersion = 2
+
+var errNewerRecord = errors.New("record was written by a newer version")
+
+// Each field's msgpack key is fixed, so that renaming a field doesn't change the stored layout.
+// Metadata is stored alongside each post, so that the server can filter and rank posts without looking them up.
 type PostRecord struct {
-	AtURI     string
-	Timestamp int64 `msgpack:"t"`
+	AtURI       string   `msgpack:"AtURI"`
+	Timestamp   int64    `msgpack:"t"`
+	DID         string   `msgpack:"d"` // Author's DID
+	CID         string   `msgpack:"c"`
+	TextLength  int      `msgpack:"l"` // Length of the post's text, in characters
+	Languages   []string `msgpack:"g"`
+	FilterScore float64  `msgpack:"s"` // How well the post passed the content filters, from zero to one
+
+	// Interaction counts are stored separately from the record, so that they can be updated without rewriting it.
+	// They're filled in when the record is read.
+	Interactions     Interactions `msgpack:"-"`
+	FirstInteraction int64        `msgpack:"-"` // Time of the first interaction with the post, or zero if there have been none
+}
+
+// Interactions counts the likes, reposts, quotes and replies a post has received since it was cached.
+// Counts may include duplicates if events are replayed, such as when the intake restarts from its last checkpoint.
+type Interactions struct {
+	Likes   int `msgpack:"l"`
+	Reposts int `msgpack:"r"`
+	Quotes  int `msgpack:"q"`
+	Replies int `msgpack:"p"`
+}
+
+// InteractionKind is a type of interaction with a post.
+type InteractionKind string
+
+const (
+	Like   InteractionKind = "likes"
+	Repost InteractionKind = "reposts"
+	Quote  InteractionKind = "quotes"
+	Reply  InteractionKind = "replies"
+)
+
+// Add returns the counts with one more interaction of the given kind.
+func (i Interactions) Add(kind InteractionKind) Interactions {
+	switch kind {
+	case Like:
+		i.Likes++
+	case Repost:
+		i.Reposts++
+	case Quote:
+		i.Quotes++
+	case Reply:
+		i.Replies++
+	}
+	return i
+}
+
+// Within determines whether each count is at most the corresponding limit.
+func (i Interactions) Within(limit Interactions) bool {
+	return i.Likes <= limit.Likes && i.Reposts <= limit.Reposts && i.Quotes <= limit.Quotes && i.Replies <= limit.Replies
+}
+
+// The stored form of a post record, tagged with the version of its layout.
+// Version 0 records were written before the version was stored. Versions 0 and 1 share the layout of version 2.
+type storedRecord struct {
+	Version    int `msgpack:"v"`
+	PostRecord `msgpack:",inline"`
 }
 
 func (p PostRecord) IsEmpty() bool {
 	return p.AtURI == "" || p.Timestamp == 0
 }
+
+// AuthorDID returns the DID of the post's author.
+// Records saved before the DID was stored fall back to parsing it from the AT URI.
+func (p PostRecord) AuthorDID() string {
+	if p.DID != "" {
+		return p.DID
+	}
+	did, _, _ := strings.Cut(strings.TrimPrefix(p.AtURI, "at://"), "/")
+	return did
+}
+
+// Encode a post record in the current version's layout.
+func encodeRecord(post PostRecord) ([]byte, error) {
+	data, err := msgpack.Marshal(storedRecord{Version: recordVersion, PostRecord: post})
+	if err != nil {
+		return nil, util.WrapErr("failed to marshal record", err)
+	}
+	return data, nil
+}
+
+// Decode a msgpack-encoded post record, in the current or any previous version. Missing data decodes to an empty record.
+func decodeRecord(data []byte) (PostRecord, error) {
+	stored, err := decodeStored(data)
+	if err != nil {
+		return PostRecord{}, err
+	}
+
+	if stored.Version > recordVersion {
+		return PostRecord{}, fmt.Errorf("%w: version %d", errNewerRecord, stored.Version)
+	}
+	return stored.PostRecord, nil
+}
+
+func decodeStored(data []byte) (storedRecord, error) {
+	var stored storedRecord
+	if data == nil {
+		return stored, nil
+	}
+	if err := msgpack.Unmarshal(data, &stored); err != nil {
+		return storedRecord{}, util.WrapErr("failed to unmarshal record", err)
+	}
+	return stored, nil
+}
+
+// Re-encode a record stored in a previous version in the current version, returning nil if it's already current.
+// Records in a newer version can't be migrated, and return an error.
+func migrateRecord(data []byte) ([]byte, error) {
+	stored, err := decodeStored(data)
+	if err != nil {
+		return nil, err
+	}
+	if stored.Version > recordVersion {
+		return nil, fmt.Errorf("%w: version %d", errNewerRecord, stored.Version)
+	}
+	if stored.Version == recordVersion {
+		return nil, nil
+	}
+	record, err := decodeRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	return encodeRecord(record)
+}
+
+// Criteria narrows the posts returned by ReadPosts. The zero value matches every lonely post, i.e. posts with no interactions.
+type Criteria struct {
+	MaxInteractions Interactions  // Only posts with at most this many interactions of each kind
+	MinAge          time.Duration // Only posts at least this old, if longer than the time it takes for a post to be lonely
+	MaxTextLength   int           // Only posts with at most this many characters, if set
+	Languages       []string      // Only posts in at least one of these languages, if set
+	MinScore        float64       // Only posts with at least this filter score
+}
+
+// Newest returns the timestamp of the newest post that can match, given the current time.
+func (c Criteria) Newest(now time.Time) int64 {
+	return now.Add(-max(c.MinAge, LonelyMinutes*time.Minute)).UnixMicro()
+}
+
+// Match determines whether a post meets the criteria, other than its age.
+func (c Criteria) Match(post PostRecord) bool {
+	if !post.Interactions.Within(c.MaxInteractions) {
+		return false
+	}
+	if c.MaxTextLength > 0 && post.TextLength > c.MaxTextLength {
+		return false
+	}
+	if len(c.Languages) > 0 && !slices.ContainsFunc(post.Languages, func(lang string) bool { return slices.Contains(c.Languages, lang) }) {
+		return false
+	}
+	return post.FilterScore >= c.MinScore
+}
+
+type OpKind int
+
+const (
+	OpSave OpKind = iota
+	OpDelete
+	OpInteract
+)
+
+// Op is a write to the cache, applied alongside others in a batch.
+type Op struct {
+	Kind OpKind
+	Hash string
+	Post PostRecord // The post to save, for OpSave
+
+	Interaction InteractionKind // The kind of interaction, for OpInteract
+	Timestamp   int64           // Time of the interaction, for OpInteract
+}
+
+// SaveOp creates an operation that saves a post record.
+func SaveOp(hash string, post PostRecord) Op {
+	return Op{Kind: OpSave, Hash: hash, Post: post}
+}
+
+// DeleteOp creates an operation that deletes a post record.
+func DeleteOp(hash string) Op {
+	return Op{Kind: OpDelete, Hash: hash}
+}
+
+// InteractOp creates an operation that counts an interaction with a post, if the post is cached.
+func InteractOp(hash string, kind InteractionKind, timestamp int64) Op {
+	return Op{Kind: OpInteract, Hash: hash, Interaction: kind, Timestamp: timestamp}
+}
+
+// The interaction counts stored alongside a post record.
+type interactionCounts struct {
+	Interactions Interactions `msgpack:"i"`
+	First        int64        `msgpack:"f"`
+}
+
+// Count an interaction. The earliest interaction time is kept, as a post's events may be processed out of order.
+func (c interactionCounts) add(kind InteractionKind, timestamp int64) interactionCounts {
+	c.Interactions = c.Interactions.Add(kind)
+	if c.First == 0 || timestamp < c.First {
+		c.First = timestamp
+	}
+	return c
+}
+
+// Fill in a post record's interaction counts.
+func (p PostRecord) withCounts(counts interactionCounts) PostRecord {
+	p.Interactions = counts.Interactions
+	p.FirstInteraction = counts.First
+	return p
+}
@@ -3,41 +3,121 @@ package config
 import (
 	"encoding/json"
 	"log/slog"
+	"time"
 
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/secrets"
 	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
 )
 
+// Public Jetstream instances, in order of preference.
+var defaultJetstreamEndpoints = []string{
+	"wss://jetstream2.us-east.bsky.network/subscribe",
+	"wss://jetstream1.us-east.bsky.network/subscribe",
+	"wss://jetstream1.us-west.bsky.network/subscribe",
+	"wss://jetstream2.us-west.bsky.network/subscribe",
+}
+
 type Config struct {
-	ValkeyAddress      string
-	ValkeyTLSEnabled   bool
-	CloudflareAPIToken string
-	CloudflareZoneID   string
-	ServerPort         string
+	CacheBackend           string        // Either 'valkey', 'bolt' for an embedded database, or 'memory' for local development
+	BoltPath               string        // Path of the database file, for the 'bolt' cache backend
+	ValkeyAddresses        []string      // Seed nodes, or sentinels in 'sentinel' mode
+	ValkeyReadAddresses    []string      // Replicas the server reads posts from, instead of the primary
+	ValkeyReplicaMaxLag    time.Duration // Read from the primary while replicas haven't heard from it for longer than this
+	ValkeyMode             string        // Either 'auto' to detect a cluster, 'single', 'cluster' or 'sentinel'
+	ValkeySentinelMaster   string        // Name of the master set monitored by the sentinels
+	ValkeySentinelUsername string
+	ValkeySentinelPassword string `json:"-"` // Omitted from the debug log
+	ValkeyUsername         string // ACL user, or empty for the default user
+	ValkeyPassword         string `json:"-"`
+	ValkeyTLSEnabled       bool
+	ValkeyCACert           string        // Path of a PEM bundle of CAs to trust, instead of the system's, when TLS is enabled
+	ValkeyClientCache      bool          // Cache post records client-side, invalidated by the server when they change
+	ValkeyClientCacheTTL   time.Duration // Maximum time a post record is cached client-side
+	DNSUpdateEnabled       bool          // Update the server's DNS record on startup, using credentials from Secrets Manager
+	CloudflareAPIToken     string
+	CloudflareZoneID       string
+	ServerPort             string
+	JetstreamEndpoints     []string
+	JetstreamStall         time.Duration // Reconnect if no event arrives within this period
+	JetstreamMaxLag        time.Duration // Reconnect if events lag behind wall-clock time by more than this
+	JetstreamCompress      bool          // Request zstd-compressed events to reduce bandwidth
+	JetstreamWantedDIDs    []string      // If set, only receive events from these DIDs
+	AdminPort              string        // Port for internal metrics, disabled if empty
+	AdminHost              string        // Interface the admin port listens on, which is only reachable locally by default
+	CursorCheckpoint       time.Duration // How often to save our position in the Jetstream
+	CursorTTL              time.Duration // How long a saved position remains valid
+	ShutdownTimeout        time.Duration // How long to wait for in-flight work when stopping
+	WorkerPoolSize         int           // Number of intake workers
+	StreamBufferSize       int           // Number of events buffered between the Jetstream and workers, shared across workers
+	WriteBatchSize         int           // Maximum number of writes each worker applies to the cache at once
+	WriteBatchInterval     time.Duration // Maximum time a write waits in a worker's batch before being applied
+	RecordDir              string        // If set, record Jetstream messages to files in this directory
+	RecordCompress         bool          // Compress recordings with zstd
+	RecordRotate           time.Duration // How often to start a new recording file
+	ReplayPath             string        // If set, replay events from this recording instead of reading the Jetstream
+	ReplaySpeed            float64       // Replay speed relative to the recording, or zero to replay as fast as possible
 }
 
 func New() (Config, error) {
-	sm, err := secrets.New()
-	if err != nil {
-		return Config{}, util.WrapErr("failed to create secrets manager", err)
-	}
+	// Cloudflare credentials are only needed to update DNS, so Secrets Manager isn't required when running locally
+	dnsUpdateEnabled := util.GetEnvBool("DNS_UPDATE_ENABLED", true)
+	var apiToken, zoneID string
+	if dnsUpdateEnabled {
+		sm, err := secrets.New()
+		if err != nil {
+			return Config{}, util.WrapErr("failed to create secrets manager", err)
+		}
 
-	apiToken, err := sm.GetCloudflareAPIToken()
-	if err != nil {
-		return Config{}, util.WrapErr("failed to get cloudflare api token", err)
-	}
+		apiToken, err = sm.GetCloudflareAPIToken()
+		if err != nil {
+			return Config{}, util.WrapErr("failed to get cloudflare api token", err)
+		}
 
-	zoneID, err := sm.GetCloudflareZoneID()
-	if err != nil {
-		return Config{}, util.WrapErr("failed to get cloudflare zone id", err)
+		zoneID, err = sm.GetCloudflareZoneID()
+		if err != nil {
+			return Config{}, util.WrapErr("failed to get cloudflare zone id", err)
+		}
 	}
 
 	result := Config{
-		ValkeyAddress:      util.GetEnvStr("VALKEY_ADDRESS", "127.0.0.1:6379"),
-		ValkeyTLSEnabled:   util.GetEnvBool("VALKEY_TLS_ENABLED", false),
-		CloudflareAPIToken: apiToken,
-		CloudflareZoneID:   zoneID,
-		ServerPort:         util.GetEnvStr("SERVER_PORT", "8080"),
+		CacheBackend:           util.GetEnvStr("CACHE_BACKEND", "valkey"),
+		BoltPath:               util.GetEnvStr("BOLT_PATH", "lonely-posts.db"),
+		ValkeyAddresses:        util.GetEnvStrSlice("VALKEY_ADDRESS", []string{"127.0.0.1:6379"}),
+		ValkeyReadAddresses:    util.GetEnvStrSlice("VALKEY_READ_ADDRESS", nil),
+		ValkeyReplicaMaxLag:    util.GetEnvDuration("VALKEY_REPLICA_MAX_LAG", 10*time.Second),
+		ValkeyMode:             util.GetEnvStr("VALKEY_MODE", "auto"),
+		ValkeySentinelMaster:   util.GetEnvStr("VALKEY_SENTINEL_MASTER", ""),
+		ValkeySentinelUsername: util.GetEnvStr("VALKEY_SENTINEL_USERNAME", ""),
+		ValkeySentinelPassword: util.GetEnvStr("VALKEY_SENTINEL_PASSWORD", ""),
+		ValkeyUsername:         util.GetEnvStr("VALKEY_USERNAME", ""),
+		ValkeyPassword:         util.GetEnvStr("VALKEY_PASSWORD", ""),
+		ValkeyTLSEnabled:       util.GetEnvBool("VALKEY_TLS_ENABLED", false),
+		ValkeyCACert:           util.GetEnvStr("VALKEY_CA_CERT", ""),
+		ValkeyClientCache:      util.GetEnvBool("VALKEY_CLIENT_CACHE", true),
+		ValkeyClientCacheTTL:   util.GetEnvDuration("VALKEY_CLIENT_CACHE_TTL", time.Minute),
+		DNSUpdateEnabled:       dnsUpdateEnabled,
+		CloudflareAPIToken:     apiToken,
+		CloudflareZoneID:       zoneID,
+		ServerPort:             util.GetEnvStr("SERVER_PORT", "8080"),
+		JetstreamEndpoints:     util.GetEnvStrSlice("JETSTREAM_ENDPOINTS", defaultJetstreamEndpoints),
+		JetstreamStall:         max(util.GetEnvDuration("JETSTREAM_STALL_TIMEOUT", 30*time.Second), time.Second),
+		JetstreamMaxLag:        util.GetEnvDuration("JETSTREAM_MAX_LAG", time.Minute),
+		JetstreamCompress:      util.GetEnvBool("JETSTREAM_COMPRESS", false),
+		JetstreamWantedDIDs:    util.GetEnvStrSlice("JETSTREAM_WANTED_DIDS", nil),
+		AdminPort:              util.GetEnvStr("ADMIN_PORT", ""),
+		AdminHost:              util.GetEnvStr("ADMIN_HOST", "127.0.0.1"),
+		CursorCheckpoint:       max(util.GetEnvDuration("CURSOR_CHECKPOINT_INTERVAL", 5*time.Second), time.Second),
+		CursorTTL:              max(util.GetEnvDuration("CURSOR_TTL", 24*time.Hour), time.Second),
+		ShutdownTimeout:        util.GetEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second),
+		WorkerPoolSize:         max(util.GetEnvInt("WORKER_POOL_SIZE", 1), 1),
+		StreamBufferSize:       max(util.GetEnvInt("STREAM_BUFFER_SIZE", 10000), 1),
+		WriteBatchSize:         max(util.GetEnvInt("WRITE_BATCH_SIZE", 100), 1),
+		WriteBatchInterval:     max(util.GetEnvDuration("WRITE_BATCH_INTERVAL", 50*time.Millisecond), time.Millisecond),
+		RecordDir:              util.GetEnvStr("RECORD_DIR", ""),
+		RecordCompress:         util.GetEnvBool("RECORD_COMPRESS", false),
+		RecordRotate:           max(util.GetEnvDuration("RECORD_ROTATE_INTERVAL", time.Hour), time.Second),
+		ReplayPath:             util.GetEnvStr("REPLAY_PATH", ""),
+		ReplaySpeed:            util.GetEnvFloat("REPLAY_SPEED", 1),
 	}
 
 	// Marshal to JSON and print if debug is enabled
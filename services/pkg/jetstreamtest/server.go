@@ -0,0 +1,249 @@
+// Package jetstreamtest provides an in-process Jetstream server for tests.
+//
+// The server speaks enough of the Jetstream subscribe protocol to exercise the intake: it honors the 'cursor',
+// 'wantedCollections' and 'wantedDids' query parameters, as well as 'options_update' messages sent by subscribers.
+package jetstreamtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/georgemblack/bluesky-lonely-posts/pkg/util"
+	"github.com/gorilla/websocket"
+)
+
+// Event is a scripted Jetstream event.
+type Event struct {
+	Data       []byte // JSON encoding, as sent to subscribers
+	DID        string
+	TimeUS     int64
+	Kind       string
+	Collection string
+}
+
+// NewEvent parses a JSON-encoded Jetstream event.
+func NewEvent(data []byte) (Event, error) {
+	var fields struct {
+		DID    string `json:"did"`
+		TimeUS int64  `json:"time_us"`
+		Kind   string `json:"kind"`
+		Commit struct {
+			Collection string `json:"collection"`
+		} `json:"commit"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return Event{}, util.WrapErr("failed to parse event", err)
+	}
+
+	return Event{
+		Data:       data,
+		DID:        fields.DID,
+		TimeUS:     fields.TimeUS,
+		Kind:       fields.Kind,
+		Collection: fields.Commit.Collection,
+	}, nil
+}
+
+// LoadSample reads an event from a JSON file (such as those in sample-data), replacing its timestamp.
+func LoadSample(path string, timeUS int64) (Event, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Event{}, util.WrapErr("failed to read sample", err)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return Event{}, util.WrapErr("failed to parse sample", err)
+	}
+	fields["time_us"] = timeUS
+
+	data, err = json.Marshal(fields)
+	if err != nil {
+		return Event{}, util.WrapErr("failed to encode sample", err)
+	}
+	return NewEvent(data)
+}
+
+// Server is an in-process Jetstream.
+// Events are published by the test, and delivered to every connected subscriber that wants them.
+// Published events are retained, so that subscribers connecting with a cursor can replay them.
+type Server struct {
+	server      *httptest.Server
+	mu          sync.Mutex
+	history     []Event
+	subscribers map[*subscriber]struct{}
+	connected   chan struct{} // Receives a value each time a subscriber connects
+}
+
+type subscriber struct {
+	mu                sync.Mutex // Guards writes and options, which can change via options_update
+	conn              *websocket.Conn
+	wantedCollections []string
+	wantedDIDs        []string
+	ready             bool // False until the subscriber sends its first message, if it asked to be required to
+}
+
+// NewServer starts a server, with the given events already in its history.
+func NewServer(history ...Event) *Server {
+	s := &Server{
+		history:     history,
+		subscribers: make(map[*subscriber]struct{}),
+		connected:   make(chan struct{}, 100),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.subscribe))
+	return s
+}
+
+// URL returns the address of the subscribe endpoint.
+func (s *Server) URL() string {
+	return "ws" + strings.TrimPrefix(s.server.URL, "http") + "/subscribe"
+}
+
+// AwaitSubscriber blocks until a subscriber connects, returning false if none connects before the timeout.
+func (s *Server) AwaitSubscriber(timeout time.Duration) bool {
+	select {
+	case <-s.connected:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Publish adds events to the history and sends them to connected subscribers.
+func (s *Server) Publish(events ...Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.history = append(s.history, events...)
+	for sub := range s.subscribers {
+		for _, event := range events {
+			sub.send(event)
+		}
+	}
+}
+
+// Drop closes every subscriber connection without a close message, simulating a network failure.
+func (s *Server) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sub := range s.subscribers {
+		sub.conn.Close()
+		delete(s.subscribers, sub)
+	}
+}
+
+// Close drops all subscribers and stops the server.
+func (s *Server) Close() {
+	s.Drop()
+	s.server.Close()
+}
+
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var cursor int64
+	if value := query.Get("cursor"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		cursor = parsed
+	}
+
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sub := &subscriber{
+		conn:              conn,
+		wantedCollections: query["wantedCollections"],
+		wantedDIDs:        query["wantedDids"],
+		ready:             query.Get("requireHello") != "true",
+	}
+
+	// Replay history from the cursor, then register for live events.
+	// Holding the lock ensures no events are published in between.
+	s.mu.Lock()
+	if cursor > 0 && sub.ready {
+		for _, event := range s.history {
+			if event.TimeUS >= cursor {
+				sub.send(event)
+			}
+		}
+	}
+	s.subscribers[sub] = struct{}{}
+	s.mu.Unlock()
+	select {
+	case s.connected <- struct{}{}:
+	default:
+	}
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, sub)
+		s.mu.Unlock()
+	}()
+
+	// Read subscriber messages until the connection closes
+	for {
+		var message struct {
+			Type    string `json:"type"`
+			Payload struct {
+				WantedCollections []string `json:"wantedCollections"`
+				WantedDIDs        []string `json:"wantedDids"`
+			} `json:"payload"`
+		}
+		if err := conn.ReadJSON(&message); err != nil {
+			return
+		}
+		if message.Type != "options_update" {
+			continue
+		}
+
+		s.mu.Lock()
+		sub.mu.Lock()
+		sub.wantedCollections = message.Payload.WantedCollections
+		sub.wantedDIDs = message.Payload.WantedDIDs
+		replay := !sub.ready && cursor > 0
+		sub.ready = true
+		sub.mu.Unlock()
+		if replay {
+			for _, event := range s.history {
+				if event.TimeUS >= cursor {
+					sub.send(event)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Send an event to the subscriber, if it wants it.
+// Account and identity events are sent to every subscriber, as they are by Jetstream.
+func (sub *subscriber) send(event Event) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if !sub.ready {
+		return
+	}
+	if len(sub.wantedDIDs) > 0 && !slices.Contains(sub.wantedDIDs, event.DID) {
+		return
+	}
+	if event.Kind == "commit" && len(sub.wantedCollections) > 0 && !slices.Contains(sub.wantedCollections, event.Collection) {
+		return
+	}
+
+	sub.conn.WriteMessage(websocket.TextMessage, event.Data)
+}
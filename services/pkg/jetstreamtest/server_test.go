@@ -0,0 +1,69 @@
+package jetstreamtest
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestServer(t *testing.T) {
+	events := []Event{
+		sample(t, "standard-post.json", 100),
+		sample(t, "like.json", 200),
+		sample(t, "repost.json", 300),
+		sample(t, "reply-post.json", 400),
+	}
+	server := NewServer(events...)
+	defer server.Close()
+
+	// Replays history from the cursor, filtered by collection
+	query := url.Values{}
+	query.Set("cursor", "200")
+	query.Add("wantedCollections", "app.bsky.feed.post")
+	query.Add("wantedCollections", "app.bsky.feed.like")
+	conn, _, err := websocket.DefaultDialer.Dial(server.URL()+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !server.AwaitSubscriber(time.Second) {
+		t.Fatal("subscriber did not connect")
+	}
+
+	// Then receives live events
+	server.Publish(sample(t, "quote-post.json", 500))
+
+	for _, expected := range []int64{200, 400, 500} {
+		event := receive(t, conn)
+		if event.TimeUS != expected {
+			t.Errorf("expected event at %d, got %d", expected, event.TimeUS)
+		}
+	}
+}
+
+func sample(t *testing.T, file string, timeUS int64) Event {
+	t.Helper()
+
+	event, err := LoadSample("../../sample-data/"+file, timeUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func receive(t *testing.T, conn *websocket.Conn) Event {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := NewEvent(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
@@ -1,7 +1,11 @@
 package util
 
 import (
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func GetEnvStr(key, defaultValue string) string {
@@ -19,3 +23,63 @@ func GetEnvBool(key string, defaultValue bool) bool {
 	}
 	return value == "true"
 }
+
+func GetEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("invalid integer, using default", "key", key, "value", value)
+		return defaultValue
+	}
+	return result
+}
+
+func GetEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	result, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("invalid number, using default", "key", key, "value", value)
+		return defaultValue
+	}
+	return result
+}
+
+// GetEnvStrSlice reads a comma-separated list of values, ignoring empty entries.
+func GetEnvStrSlice(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	result := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	if len(result) == 0 {
+		return defaultValue
+	}
+	return result
+}
+
+// GetEnvDuration reads a duration such as "30s" or "5m", falling back to the default if it cannot be parsed.
+func GetEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("invalid duration, using default", "key", key, "value", value)
+		return defaultValue
+	}
+	return duration
+}